@@ -6,58 +6,192 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/gdotgordon/ipverify/auth"
 	"github.com/gdotgordon/ipverify/service"
 	"github.com/gdotgordon/ipverify/types"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	pkgerr "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
 // Definitions for the supported URL endpoints.
 const (
-	statusURL = "/v1/status" // ping
-	verifyURL = "/v1/verify" // call to check for suspicious behavior
-	resetURL  = "/v1/reset"  // clears the DB, mostly used for testing
+	statusURL = "/v1/status"                               // ping
+	readyURL  = "/v1/ready"                                // checks the dependencies
+	verifyURL = "/v1/verify"                               // call to check for suspicious behavior
+	resetURL  = "/v1/admin/reset"                          // clears the DB, mostly used for testing
+	reloadURL = "/v1/admin/reload"                         // reloads the Maxmind DB
+	batchURL  = "/v1/verify/batch"                         // verifies a batch of logins
+	denyURL   = "/v1/denylist"                             // lists and adds denylist entries
+	denyEntry = "/v1/denylist/{entry:.+}"                  // deletes a denylist entry
+	usersURL  = "/v1/users/{username}"                     // deletes a user's events
+	eventsURL = "/v1/users/{username}/events"              // lists a user's login history
+	eventURL  = "/v1/users/{username}/events/{event_uuid}" // deletes an event
 )
 
+const (
+	// maxBatchSize is the maximum number of requests in a batch verify,
+	// and maxBatchBytes the maximum size of its body, which allows over 4KB
+	// per request.
+	maxBatchSize  = 1000
+	maxBatchBytes = 4 << 20
+
+	// defaultPageSize and maxPageSize limit the number of events listed.
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// APIKeyHeader is the header carrying the API key.
+const APIKeyHeader = "X-API-Key"
+
+// The headers carrying the HMAC signature of a request and its inputs.
+const (
+	SignatureHeader = "X-Signature"
+	ClientHeader    = "X-Client-Id"
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+)
+
+// maxSignedBodySize limits the size of a signed request body, since it is
+// read in full before the signature can be checked.
+const maxSignedBodySize = 8 << 20
+
+// ResetConfirmation is the value of the confirm query parameter required
+// to reset the database.
+const ResetConfirmation = "delete-all-events"
+
 // API is the item that dispatches to the endpoint implementations
 type apiImpl struct {
-	service service.Service
-	log     *zap.SugaredLogger
+	service      service.Service
+	log          *zap.SugaredLogger
+	adminToken   string
+	disableReset bool
+	keys         *auth.KeyStore
+	hmac         *auth.HMACVerifier
+	timeout      time.Duration
+}
+
+// Option is used to configure the API layer.
+type Option func(*apiImpl)
+
+// WithAdminToken sets the credential required for destructive admin
+// endpoints.  Without it, those endpoints always refuse.
+func WithAdminToken(token string) Option {
+	return func(ap *apiImpl) {
+		ap.adminToken = token
+	}
+}
+
+// WithAPIKeys requires requests other than the status check to carry an
+// API key in the X-API-Key header, whose client has the endpoint's scope.
+// Without it, the endpoints are open.
+func WithAPIKeys(keys *auth.KeyStore) Option {
+	return func(ap *apiImpl) {
+		ap.keys = keys
+	}
+}
+
+// WithHMAC allows the verify endpoints to be called with requests signed
+// by a shared secret, instead of an API key.
+func WithHMAC(hv *auth.HMACVerifier) Option {
+	return func(ap *apiImpl) {
+		ap.hmac = hv
+	}
+}
+
+// WithRequestTimeout sets the deadline for handling each request, after
+// which any work in progress in the service and store is abandoned, and a
+// 503 is returned.  Without it, requests only end when they complete or
+// the client goes away.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(ap *apiImpl) {
+		ap.timeout = d
+	}
+}
+
+// WithResetDisabled removes the reset endpoint entirely, as is recommended
+// in production.
+func WithResetDisabled() Option {
+	return func(ap *apiImpl) {
+		ap.disableReset = true
+	}
 }
 
 // Init sets up the endpoint processing.  There is nothing returned, other
 // than potential errors, because the endpoint handling is configured in
-// the passed-in muxer.
-func Init(ctx context.Context, r *mux.Router, service service.Service, log *zap.SugaredLogger) error {
+// the passed-in muxer.  Each request is handled with its own context,
+// which is cancelled if the client disconnects or the request times out.
+func Init(r *mux.Router, service service.Service, log *zap.SugaredLogger,
+	opts ...Option) error {
 	ap := apiImpl{service: service, log: log}
+	for _, o := range opts {
+		o(&ap)
+	}
 	r.HandleFunc(statusURL, ap.getStatus).Methods(http.MethodGet)
-	r.HandleFunc(verifyURL, ap.verifyIP).Methods(http.MethodPost)
-	r.HandleFunc(resetURL, ap.reset).Methods(http.MethodGet)
+	r.HandleFunc(readyURL, ap.getReady).Methods(http.MethodGet)
+	r.Handle(metricsURL, promhttp.Handler()).Methods(http.MethodGet)
+	r.HandleFunc(verifyURL, ap.require(auth.ScopeVerify, ap.verifyIP)).Methods(http.MethodPost)
+	r.HandleFunc(batchURL, ap.require(auth.ScopeVerify, ap.verifyBatch)).Methods(http.MethodPost)
+	if !ap.disableReset {
+		r.HandleFunc(resetURL, ap.require(auth.ScopeAdmin, ap.reset)).Methods(http.MethodPost,
+			http.MethodDelete)
+	}
+	r.HandleFunc(reloadURL, ap.require(auth.ScopeAdmin, ap.reloadGeoDB)).Methods(http.MethodPost)
+	r.HandleFunc(denyURL, ap.require(auth.ScopeRead, ap.getDenylist)).Methods(http.MethodGet)
+	r.HandleFunc(denyURL, ap.require(auth.ScopeAdmin, ap.addDenylistEntry)).Methods(http.MethodPost)
+	r.HandleFunc(denyEntry, ap.require(auth.ScopeAdmin, ap.removeDenylistEntry)).Methods(http.MethodDelete)
+	r.HandleFunc(eventsURL, ap.require(auth.ScopeRead, ap.getUserEvents)).Methods(http.MethodGet)
+	r.HandleFunc(usersURL, ap.require(auth.ScopeAdmin, ap.deleteUser)).Methods(http.MethodDelete)
+	r.HandleFunc(eventURL, ap.require(auth.ScopeAdmin, ap.deleteEvent)).Methods(http.MethodDelete)
 
-	var wrapContext = func(next http.Handler) http.Handler {
+	var requestTimeout = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rc := r.WithContext(ctx)
-			next.ServeHTTP(w, rc)
+			if ap.timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), ap.timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 
+	// The request is logged once handled, as the client is only known after
+	// require has authenticated it.
 	var loggingMiddleware = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Infow("Handling URL", "url", r.URL)
-			next.ServeHTTP(w, r)
+			cc := &clientCapture{ctx: r.Context()}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCaptureKey{}, cc)))
+			if client, ok := auth.FromContext(cc.ctx); ok {
+				log.Infow("Handled URL", "url", r.URL, "client", client.Name)
+				return
+			}
+			log.Infow("Handled URL", "url", r.URL)
 		})
 	}
+	r.Use(metricsMiddleware)
 	r.Use(loggingMiddleware)
-	r.Use(wrapContext)
+	r.Use(requestTimeout)
 	return nil
 }
 
@@ -67,7 +201,9 @@ func (a apiImpl) getStatus(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 	}
 
-	sr := types.StatusResponse{Status: "IP verify service is up and running"}
+	info := a.service.GeoDBInfo()
+	sr := types.StatusResponse{Status: "IP verify service is up and running", GeoDB: &info,
+		Pruning: a.service.PruneStats()}
 	b, err := json.MarshalIndent(sr, "", "  ")
 	if err != nil {
 		a.writeErrorResponse(w, http.StatusInternalServerError, err)
@@ -78,6 +214,17 @@ func (a apiImpl) getStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// Readiness check endpoint.  Unlike the liveness check, it returns a 503
+// if the store or the geolocation database is not usable.
+func (a apiImpl) getReady(w http.ResponseWriter, r *http.Request) {
+	resp := a.service.Ready(r.Context())
+	code := http.StatusOK
+	if resp.Status != types.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	a.writeJSON(w, code, resp)
+}
+
 // Verify a potentially suspicious IP address
 func (a apiImpl) verifyIP(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
@@ -86,6 +233,12 @@ func (a apiImpl) verifyIP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
 	var request types.VerifyRequest
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&request); err != nil {
@@ -93,6 +246,8 @@ func (a apiImpl) verifyIP(w http.ResponseWriter, r *http.Request) {
 			"unmarshaling request body"))
 		return
 	}
+	request.DryRun = request.DryRun || dryRun
+	request.Client = clientName(r)
 
 	// Validate the parameters from the JSON.
 	if err := validateVerifyRequest(request); err != nil {
@@ -101,9 +256,9 @@ func (a apiImpl) verifyIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := a.service.VerifyIP(request)
+	response, err := a.service.VerifyIP(r.Context(), request)
 	if err != nil {
-		a.writeErrorResponse(w, http.StatusBadRequest, err)
+		a.writeServiceError(w, err)
 		return
 	}
 
@@ -120,14 +275,449 @@ func (a apiImpl) verifyIP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a *apiImpl) reset(w http.ResponseWriter, r *http.Request) {
-	if err := a.service.ResetStore(); err != nil {
-		if _, ok := err.(service.Error); ok {
-			a.writeErrorResponse(w, http.StatusInternalServerError, err)
-		} else {
-			a.writeErrorResponse(w, http.StatusBadRequest, err)
+// Verify a batch of logins, sent as either a JSON array or a stream of
+// newline-delimited JSON objects.  The overall status is OK as long as the
+// batch itself is well-formed, with a status for each item.
+func (a apiImpl) verifyBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, errors.New("No body for POST"))
+		return
+	}
+	defer r.Body.Close()
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	requests, err := decodeBatch(http.MaxBytesReader(w, r.Body, maxBatchBytes), maxBatchSize)
+	if _, ok := err.(batchLimitError); ok {
+		a.writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, pkgerr.Wrap(err,
+			"unmarshaling request body"))
+		return
+	}
+
+	// Only send the valid requests to the service, keeping track of where
+	// each one came from.
+	results := make([]types.BatchVerifyResult, len(requests))
+	var valid []types.VerifyRequest
+	var validIdx []int
+	for i, req := range requests {
+		results[i].Index = i
+		req.DryRun = req.DryRun || dryRun
+		req.Client = clientName(r)
+		if err := validateVerifyRequest(req); err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = pkgerr.Wrap(err, "validating request").Error()
+			continue
+		}
+		valid = append(valid, req)
+		validIdx = append(validIdx, i)
+	}
+
+	for j, res := range a.service.VerifyBatch(r.Context(), valid) {
+		i := validIdx[j]
+		if res.Err != nil {
+			results[i].Status = serviceErrorCode(res.Err)
+			results[i].Error = res.Err.Error()
+			continue
+		}
+		results[i].Status = http.StatusOK
+		results[i].Result = res.Response
+	}
+	a.writeJSON(w, http.StatusOK, types.BatchVerifyResponse{Results: results})
+}
+
+// dryRunParam gets the optional dry_run query parameter, which applies to
+// all the requests in the body.
+func dryRunParam(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid dry_run parameter: %s", v)
+	}
+	return dryRun, nil
+}
+
+// batchLimitError is the error for a batch of more than the maximum number
+// of requests.
+type batchLimitError int
+
+func (e batchLimitError) Error() string {
+	return fmt.Sprintf("batch exceeds limit of %d requests", int(e))
+}
+
+// decodeBatch decodes either a JSON array of verify requests, or a stream
+// of them, one after the other.  A stream is abandoned as soon as it has
+// more than the limit of requests.
+func decodeBatch(body io.Reader, limit int) ([]types.VerifyRequest, error) {
+	br := bufio.NewReader(body)
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if !unicode.IsSpace(rune(b)) {
+			first = b
+			break
+		}
+	}
+	if err := br.UnreadByte(); err != nil {
+		return nil, err
+	}
+
+	var requests []types.VerifyRequest
+	decoder := json.NewDecoder(br)
+	if first == '[' {
+		if err := decoder.Decode(&requests); err != nil {
+			return nil, err
+		}
+		if len(requests) > limit {
+			return nil, batchLimitError(limit)
+		}
+		return requests, nil
+	}
+	for {
+		var req types.VerifyRequest
+		err := decoder.Decode(&req)
+		if err == io.EOF {
+			return requests, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %v", len(requests), err)
+		}
+		if len(requests) == limit {
+			return nil, batchLimitError(limit)
+		}
+		requests = append(requests, req)
+	}
+}
+
+// Reset the database, deleting every event.  This requires the admin
+// credential and an explicit confirmation, so it can't happen by accident.
+func (a apiImpl) reset(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if code, err := a.checkAdmin(r); err != nil {
+		a.writeErrorResponse(w, code, err)
+		return
+	}
+	if r.URL.Query().Get("confirm") != ResetConfirmation {
+		a.writeErrorResponse(w, http.StatusBadRequest,
+			fmt.Errorf("reset requires confirm=%s", ResetConfirmation))
+		return
+	}
+	n, err := a.service.ResetStore(r.Context())
+	if err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, types.StatusResponse{
+		Status:  fmt.Sprintf("database reset, %d events deleted", n),
+		Deleted: n,
+	})
+}
+
+// require wraps a handler to authenticate the API key or signature, and
+// check the client has the scope.  The client is added to the request
+// context.  Without API keys or signatures, the admin scope still requires
+// the admin token.
+func (a apiImpl) require(scope auth.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Without API keys, only the verify endpoints may need a signature,
+		// and the admin endpoints need the admin token.
+		if a.keys == nil && (a.hmac == nil || scope != auth.ScopeVerify) {
+			if scope == auth.ScopeAdmin {
+				if code, err := a.checkAdmin(r); err != nil {
+					a.writeErrorResponse(w, code, err)
+					return
+				}
+			}
+			next(w, r)
+			return
+		}
+
+		var client auth.Client
+		switch {
+		case a.hmac != nil && r.Header.Get(SignatureHeader) != "":
+			var err error
+			if client, err = a.verifySignature(r); err != nil {
+				a.writeErrorResponse(w, http.StatusUnauthorized, err)
+				return
+			}
+		case a.keys != nil:
+			var ok bool
+			if client, ok = a.keys.Authenticate(r.Header.Get(APIKeyHeader)); !ok {
+				a.writeErrorResponse(w, http.StatusUnauthorized, errors.New("invalid API key"))
+				return
+			}
+		default:
+			a.writeErrorResponse(w, http.StatusUnauthorized, errors.New("missing signature"))
+			return
+		}
+		if !client.Has(scope) {
+			a.writeErrorResponse(w, http.StatusForbidden,
+				fmt.Errorf("client %s does not have the %s scope", client.Name, scope))
+			return
+		}
+		ctx := auth.NewContext(r.Context(), client)
+		if cc, ok := ctx.Value(clientCaptureKey{}).(*clientCapture); ok {
+			cc.ctx = ctx
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// clientCapture passes the context carrying the authenticated client back
+// from require to the logging middleware, which runs before it.
+type clientCapture struct {
+	ctx context.Context
+}
+
+type clientCaptureKey struct{}
+
+// verifySignature checks the HMAC signature of the request.  The body is
+// read to check it, and replaced so the handler can read it again.
+func (a apiImpl) verifySignature(r *http.Request) (auth.Client, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+		r.Body.Close()
+		if err != nil {
+			return auth.Client{}, pkgerr.Wrap(err, "reading request body")
+		}
+		if len(body) > maxSignedBodySize {
+			return auth.Client{}, fmt.Errorf("signed body exceeds %d bytes", maxSignedBodySize)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return a.hmac.Verify(r.Header.Get(ClientHeader), r.Method, r.URL.RequestURI(),
+		r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader),
+		r.Header.Get(SignatureHeader), body)
+}
+
+// clientName returns the name of the authenticated client, if any.
+func clientName(r *http.Request) string {
+	client, _ := auth.FromContext(r.Context())
+	return client.Name
+}
+
+// checkAdmin verifies the request comes from a client with the admin scope,
+// or carries the admin credential as a bearer token, returning the status
+// code to refuse it with if not.
+func (a apiImpl) checkAdmin(r *http.Request) (int, error) {
+	if client, ok := auth.FromContext(r.Context()); ok && client.Has(auth.ScopeAdmin) {
+		return 0, nil
+	}
+	if a.adminToken == "" {
+		return http.StatusForbidden, errors.New("no admin credential is configured")
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return http.StatusUnauthorized, errors.New("invalid admin credential")
+	}
+	got := sha256.Sum256([]byte(strings.TrimPrefix(header, "Bearer ")))
+	want := sha256.Sum256([]byte(a.adminToken))
+	if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		return http.StatusUnauthorized, errors.New("invalid admin credential")
+	}
+	return 0, nil
+}
+
+// Reload the Maxmind DB, for example after a weekly update of the file.
+func (a apiImpl) reloadGeoDB(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	if err := a.service.ReloadGeoDB(); err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+
+	info := a.service.GeoDBInfo()
+	sr := types.StatusResponse{Status: "geolocation database reloaded", GeoDB: &info}
+	b, err := json.MarshalIndent(sr, "", "  ")
+	if err != nil {
+		a.writeErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// List the denylist entries.
+func (a apiImpl) getDenylist(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	entries, err := a.service.GetDenylist(r.Context())
+	if err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []types.DenylistEntry{}
+	}
+	a.writeJSON(w, http.StatusOK, types.DenylistResponse{Entries: entries})
+}
+
+// Add an IP address or CIDR block to the denylist.
+func (a apiImpl) addDenylistEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, errors.New("No body for POST"))
+		return
+	}
+	defer r.Body.Close()
+
+	var entry types.DenylistEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, pkgerr.Wrap(err,
+			"unmarshaling request body"))
+		return
+	}
+	entry, err := a.service.AddDenylistEntry(r.Context(), entry)
+	if err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusCreated, entry)
+}
+
+// Remove an IP address or CIDR block from the denylist.
+func (a apiImpl) removeDenylistEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	entry := mux.Vars(r)["entry"]
+	if err := a.service.RemoveDenylistEntry(r.Context(), entry); err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, types.StatusResponse{
+		Status: fmt.Sprintf("denylist entry %s removed", entry)})
+}
+
+// List a page of a user's login history, newest first unless requested
+// otherwise.
+func (a apiImpl) getUserEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	query, err := parseEventQuery(r.URL.Query())
+	if err != nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := a.service.GetUserEvents(r.Context(), mux.Vars(r)["username"], query)
+	if err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, resp)
+}
+
+// Delete all of a user's events, such as for an erasure request.
+func (a apiImpl) deleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	username := mux.Vars(r)["username"]
+	n, err := a.service.DeleteUser(r.Context(), username)
+	if err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, types.StatusResponse{
+		Status:  fmt.Sprintf("events for user %s deleted", username),
+		Deleted: n,
+	})
+}
+
+// Delete a single event for a user.
+func (a apiImpl) deleteEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	vars := mux.Vars(r)
+	if _, err := uuid.Parse(vars["event_uuid"]); err != nil {
+		a.writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	n, err := a.service.DeleteEvent(r.Context(), vars["username"], vars["event_uuid"])
+	if err != nil {
+		a.writeServiceError(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, types.StatusResponse{
+		Status:  fmt.Sprintf("event %s deleted", vars["event_uuid"]),
+		Deleted: n,
+	})
+}
+
+// parseEventQuery gets the time range, paging and sort order for listing
+// events from the query parameters, applying the defaults.
+func parseEventQuery(params url.Values) (types.EventQuery, error) {
+	query := types.EventQuery{Limit: defaultPageSize, Order: types.Descending}
+	for _, p := range []struct {
+		name string
+		val  *int64
+	}{
+		{"from", &query.From},
+		{"to", &query.To},
+	} {
+		if v := params.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return query, fmt.Errorf("invalid %s timestamp: %s", p.name, v)
+			}
+			*p.val = n
+		}
+	}
+	if query.From != 0 && query.To != 0 && query.From > query.To {
+		return query, fmt.Errorf("from %d is after to %d", query.From, query.To)
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return query, fmt.Errorf("invalid limit: %s (must be 1 to %d)", v, maxPageSize)
+		}
+		query.Limit = n
+	}
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("invalid offset: %s", v)
 		}
+		query.Offset = n
 	}
+	if v := params.Get("order"); v != "" {
+		switch o := types.SortOrder(strings.ToLower(v)); o {
+		case types.Ascending, types.Descending:
+			query.Order = o
+		default:
+			return query, fmt.Errorf("invalid order: %s", v)
+		}
+	}
+	return query, nil
 }
 
 // validateVerifyRequest does field-level validation on the incoming
@@ -145,9 +735,58 @@ func validateVerifyRequest(request types.VerifyRequest) error {
 	if net.ParseIP(request.IPAddress) == nil {
 		return fmt.Errorf("invalid IP address: %s", request.IPAddress)
 	}
+	if request.MaxSpeed < 0 {
+		return fmt.Errorf("invalid max speed: %g", request.MaxSpeed)
+	}
+	if request.SpeedUnit != "" {
+		if _, err := types.ParseSpeedUnit(string(request.SpeedUnit)); err != nil {
+			return err
+		}
+		if request.MaxSpeed == 0 {
+			return fmt.Errorf("speed unit %s given without max speed", request.SpeedUnit)
+		}
+	}
 	return nil
 }
 
+// writeJSON serializes a response with the specified code.
+func (a apiImpl) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		a.writeErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		a.log.Errorw("writing response body", "error", err)
+	}
+}
+
+// writeServiceError maps errors from the service to the HTTP status code:
+// internal errors are server errors, missing items are not found, requests
+// that timed out or were cancelled are unavailable, and anything else is
+// the user's fault.
+func (a apiImpl) writeServiceError(w http.ResponseWriter, err error) {
+	a.writeErrorResponse(w, serviceErrorCode(err), err)
+}
+
+// serviceErrorCode returns the HTTP status code for an error from the
+// service.
+func serviceErrorCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable
+	}
+	switch err.(type) {
+	case service.Error:
+		return http.StatusInternalServerError
+	case service.NotFoundError:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
 // For HTTP bad request responses, serialize a JSON status message with
 // the cause.
 func (a apiImpl) writeErrorResponse(w http.ResponseWriter, code int, err error) {
@@ -2,15 +2,31 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gdotgordon/ipverify/auth"
+	"github.com/gdotgordon/ipverify/service"
 	"github.com/gdotgordon/ipverify/types"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
+// testAdminToken is the admin token for tests of the admin endpoints.
+const testAdminToken = "s3cret"
+
 // The following will be converted to JSON to emulate responses from
 // the real service.
 var (
@@ -49,7 +65,7 @@ var (
 )
 
 func TestStatusEndpoint(t *testing.T) {
-	api := apiImpl{log: newTestLogger(t)}
+	api := apiImpl{service: &mockService{}, log: newTestLogger(t)}
 	req, err := http.NewRequest(http.MethodGet, statusURL, nil)
 	if err != nil {
 		t.Fatal(err)
@@ -65,7 +81,9 @@ func TestStatusEndpoint(t *testing.T) {
 		t.Fatalf("handler returned wrong status code: got %d, expected %d",
 			rr.Code, http.StatusOK)
 	}
-	expected := "{\n" + `  "status": "IP verify service is up and running"` + "\n}"
+	expected := "{\n" + `  "status": "IP verify service is up and running",` + "\n" +
+		`  "geoDb": {` + "\n" + `    "type": "GeoLite2-City",` + "\n" +
+		`    "buildEpoch": 1560291614` + "\n  }\n}"
 	body := rr.Body.String()
 	if body != expected {
 		t.Fatalf("unexpected body: %s, expected %s", body, expected)
@@ -138,6 +156,13 @@ func TestVerify(t *testing.T) {
 			expStatus:    http.StatusBadRequest,
 			expErrMsg:    "validating request: invalid timestamp: -4",
 		},
+		{
+			useName: "bob",
+			verifyReq: types.VerifyRequest{UnixTimestamp: req1.UnixTimestamp, EventUUID: req1.EventUUID,
+				IPAddress: req1.IPAddress, SpeedUnit: "KPH"},
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "validating request: speed unit KPH given without max speed",
+		},
 	} {
 		ms := &mockService{}
 		api := apiImpl{service: ms, log: newTestLogger(t)}
@@ -145,7 +170,7 @@ func TestVerify(t *testing.T) {
 		handler := http.HandlerFunc(api.verifyIP)
 
 		// Prep the request based on the chosen params.
-		vreq := req1
+		vreq := v.verifyReq
 		vreq.Username = v.useName
 		if v.badUUID {
 			vreq.EventUUID = "XXX"
@@ -225,6 +250,1006 @@ func TestVerify(t *testing.T) {
 	}
 }
 
+// TestReadyEndpoint checks the readiness response, and that a degraded
+// dependency makes the service unavailable.
+func TestReadyEndpoint(t *testing.T) {
+	for i, v := range []struct {
+		degraded  bool
+		expStatus int
+		expBody   string
+	}{
+		{
+			expStatus: http.StatusOK,
+			expBody: `{
+  "status": "ready",
+  "store": {
+    "status": "ready",
+    "events": 3,
+    "denylistEntries": 1
+  },
+  "geoDb": {
+    "status": "ready",
+    "canaryIp": "81.2.69.142",
+    "buildDate": "2019-06-11T22:20:14Z",
+    "type": "GeoLite2-City",
+    "buildEpoch": 1560291614
+  }
+}`,
+		},
+		{
+			degraded:  true,
+			expStatus: http.StatusServiceUnavailable,
+			expBody: `{
+  "status": "degraded",
+  "store": {
+    "status": "degraded",
+    "error": "sql: database is closed",
+    "events": 0,
+    "denylistEntries": 0
+  },
+  "geoDb": {
+    "status": "ready",
+    "canaryIp": "81.2.69.142",
+    "buildDate": "2019-06-11T22:20:14Z",
+    "type": "GeoLite2-City",
+    "buildEpoch": 1560291614
+  }
+}`,
+		},
+	} {
+		r := mux.NewRouter()
+		if err := Init(r, &mockService{degraded: v.degraded},
+			newTestLogger(t)); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodGet, readyURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Errorf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if body := rr.Body.String(); body != v.expBody {
+			t.Errorf("(%d) unexpected body: %s, expected %s", i, body, v.expBody)
+		}
+	}
+}
+
+func TestVerifyDryRun(t *testing.T) {
+	for i, v := range []struct {
+		query     string
+		field     bool
+		expStatus int
+		expDryRun bool
+		expErrMsg string
+	}{
+		{expStatus: http.StatusOK},
+		{query: "?dry_run=true", expStatus: http.StatusOK, expDryRun: true},
+		{query: "?dry_run=1", expStatus: http.StatusOK, expDryRun: true},
+		{query: "?dry_run=false", expStatus: http.StatusOK},
+		{field: true, expStatus: http.StatusOK, expDryRun: true},
+		{
+			query:     "?dry_run=maybe",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "invalid dry_run parameter: maybe",
+		},
+	} {
+		ms := &mockService{}
+		api := apiImpl{service: ms, log: newTestLogger(t)}
+		vreq := req1
+		vreq.Username = "NoPredOrSucc"
+		vreq.DryRun = v.field
+		b, err := json.Marshal(vreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, verifyURL+v.query, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.verifyIP).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if v.expStatus != http.StatusOK {
+			var status types.StatusResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+				t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+			}
+			if status.Status != v.expErrMsg {
+				t.Errorf("(%d) expected err message '%s', got '%s'", i, v.expErrMsg, status.Status)
+			}
+			continue
+		}
+		var resp types.VerifyResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if ms.lastReq.DryRun != v.expDryRun || resp.DryRun != v.expDryRun {
+			t.Errorf("(%d) expected dry run %t, got request %t, response %t", i,
+				v.expDryRun, ms.lastReq.DryRun, resp.DryRun)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	vreq := req1
+	vreq.Username = "Slow"
+	b, err := json.Marshal(vreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The service gives up at the deadline, or as soon as the client
+	// disconnects, which cancels the request's context.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, v := range []struct {
+		ctx       context.Context
+		opts      []Option
+		expErrMsg string
+	}{
+		{
+			ctx:       context.Background(),
+			opts:      []Option{WithRequestTimeout(20 * time.Millisecond)},
+			expErrMsg: "add record to store: context deadline exceeded",
+		},
+		{
+			ctx:       cancelled,
+			expErrMsg: "add record to store: context canceled",
+		},
+	} {
+		r := mux.NewRouter()
+		if err := Init(r, &mockService{}, newTestLogger(t), v.opts...); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequestWithContext(v.ctx, http.MethodPost, verifyURL,
+			bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("(%d) wrong status code: got %d, expected %d", i, rr.Code,
+				http.StatusServiceUnavailable)
+		}
+		var status types.StatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+		}
+		if status.Status != v.expErrMsg {
+			t.Errorf("(%d) expected err message '%s', got '%s'", i, v.expErrMsg, status.Status)
+		}
+	}
+}
+
+func TestVerifyBatch(t *testing.T) {
+	var items []string
+	for _, name := range []string{"PredOnly", "Duplicate", "", "Broken", "SuccOnly"} {
+		vreq := req1
+		vreq.Username = name
+		b, err := json.Marshal(vreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, string(b))
+	}
+	expResults := []types.BatchVerifyResult{
+		{
+			Index:  0,
+			Status: http.StatusOK,
+			Result: &types.VerifyResponse{CurrentGeo: validCurrGeo, PrecedingIPAccess: &validGeoEvent},
+		},
+		{
+			Index:  1,
+			Status: http.StatusBadRequest,
+			Error:  "add record to store: UNIQUE constraint failed: requests.UUID",
+		},
+		{Index: 2, Status: http.StatusBadRequest, Error: "validating request: missing username"},
+		{Index: 3, Status: http.StatusInternalServerError, Error: "database is locked"},
+		{
+			Index:  4,
+			Status: http.StatusOK,
+			Result: &types.VerifyResponse{CurrentGeo: validCurrGeo, SubsequentIPAccess: &validGeoEvent2},
+		},
+	}
+
+	for i, v := range []struct {
+		body       string
+		expStatus  int
+		expResults []types.BatchVerifyResult
+		expErrMsg  string
+	}{
+		{
+			body:       "[" + strings.Join(items, ",") + "]",
+			expStatus:  http.StatusOK,
+			expResults: expResults,
+		},
+		{
+			body:       "\n" + strings.Join(items, "\n") + "\n",
+			expStatus:  http.StatusOK,
+			expResults: expResults,
+		},
+		{
+			body:       "[]",
+			expStatus:  http.StatusOK,
+			expResults: []types.BatchVerifyResult{},
+		},
+		{
+			body:      items[0] + "\n{\"username\": ",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "unmarshaling request body: item 1: unexpected EOF",
+		},
+		{
+			body:      "",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "unmarshaling request body: EOF",
+		},
+		{
+			body:      "[" + strings.TrimSuffix(strings.Repeat(items[0]+",", maxBatchSize+1), ",") + "]",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "batch exceeds limit of 1000 requests",
+		},
+		{
+			// The stream is rejected at the request past the limit,
+			// before the rest is read.
+			body:      strings.Repeat(items[0]+"\n", maxBatchSize+1) + "{\"username\": ",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "batch exceeds limit of 1000 requests",
+		},
+		{
+			body:      "[" + strings.Repeat(" ", maxBatchBytes) + "]",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "unmarshaling request body: http: request body too large",
+		},
+	} {
+		api := apiImpl{service: &mockService{}, log: newTestLogger(t)}
+		req, err := http.NewRequest(http.MethodPost, batchURL, strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.verifyBatch).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if v.expStatus != http.StatusOK {
+			var status types.StatusResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+				t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+			}
+			if status.Status != v.expErrMsg {
+				t.Errorf("(%d) expected err message '%s', got '%s'", i, v.expErrMsg, status.Status)
+			}
+			continue
+		}
+		var resp types.BatchVerifyResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("(%d) can't unmarshal response: %v", i, err)
+		}
+		if !reflect.DeepEqual(resp.Results, v.expResults) {
+			t.Errorf("(%d) expected results %+v, got %+v", i, v.expResults, resp.Results)
+		}
+	}
+}
+
+func TestUserEventsEndpoint(t *testing.T) {
+	for i, v := range []struct {
+		query     string
+		expStatus int
+		expQuery  types.EventQuery
+		expErrMsg string
+	}{
+		{
+			expStatus: http.StatusOK,
+			expQuery:  types.EventQuery{Limit: defaultPageSize, Order: types.Descending},
+		},
+		{
+			query:     "?from=1514000000&to=1515000000&limit=10&offset=20&order=ASC",
+			expStatus: http.StatusOK,
+			expQuery: types.EventQuery{From: 1514000000, To: 1515000000, Limit: 10,
+				Offset: 20, Order: types.Ascending},
+		},
+		{
+			query:     "?from=yesterday",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "invalid from timestamp: yesterday",
+		},
+		{
+			query:     "?from=1515000000&to=1514000000",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "from 1515000000 is after to 1514000000",
+		},
+		{
+			query:     "?limit=501",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "invalid limit: 501 (must be 1 to 500)",
+		},
+		{
+			query:     "?offset=-1",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "invalid offset: -1",
+		},
+		{
+			query:     "?order=random",
+			expStatus: http.StatusBadRequest,
+			expErrMsg: "invalid order: random",
+		},
+	} {
+		ms := &mockService{}
+		r := mux.NewRouter()
+		if err := Init(r, ms, newTestLogger(t)); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodGet, "/v1/users/bob/events"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if v.expStatus != http.StatusOK {
+			var status types.StatusResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+				t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+			}
+			if status.Status != v.expErrMsg {
+				t.Errorf("(%d) expected err message '%s', got '%s'", i, v.expErrMsg, status.Status)
+			}
+			continue
+		}
+		if ms.lastQuery != v.expQuery {
+			t.Errorf("(%d) expected query %+v, got %+v", i, v.expQuery, ms.lastQuery)
+		}
+		var resp types.UserEventsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Username != "bob" || len(resp.Events) != 1 ||
+			resp.Events[0].Geo != validCurrGeo || *resp.Events[0].FromPrevious != validGeoEvent2 {
+			t.Errorf("(%d) unexpected response %+v", i, resp)
+		}
+	}
+}
+
+// TestDeleteEndpoints checks the delete endpoints, which need the admin
+// token when there are no API keys.
+func TestDeleteEndpoints(t *testing.T) {
+	r := mux.NewRouter()
+	if err := Init(r, &mockService{}, newTestLogger(t), WithAdminToken(testAdminToken)); err != nil {
+		t.Fatal(err)
+	}
+	noToken := mux.NewRouter()
+	if err := Init(noToken, &mockService{}, newTestLogger(t)); err != nil {
+		t.Fatal(err)
+	}
+	otherUUID := "0c6e2b8e-7b8a-4a4f-9d5e-2f3a1c9b8d7e"
+	for i, v := range []struct {
+		router     *mux.Router
+		url        string
+		auth       string
+		expStatus  int
+		expMsg     string
+		expDeleted int64
+	}{
+		{
+			url:       "/v1/users/bob",
+			auth:      "-",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+		{
+			url:       "/v1/users/bob",
+			auth:      "Bearer nope",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+		{
+			router:    noToken,
+			url:       "/v1/users/bob",
+			expStatus: http.StatusForbidden,
+			expMsg:    "no admin credential is configured",
+		},
+		{
+			url:       "/v1/users/bob/events/" + req1.EventUUID,
+			auth:      "-",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+		{
+			url:        "/v1/users/bob",
+			expStatus:  http.StatusOK,
+			expMsg:     "events for user bob deleted",
+			expDeleted: 3,
+		},
+		{
+			url:       "/v1/users/alice",
+			expStatus: http.StatusNotFound,
+			expMsg:    "no events found for user alice",
+		},
+		{
+			url:        "/v1/users/bob/events/" + req1.EventUUID,
+			expStatus:  http.StatusOK,
+			expMsg:     "event " + req1.EventUUID + " deleted",
+			expDeleted: 1,
+		},
+		{
+			url:       "/v1/users/bob/events/" + otherUUID,
+			expStatus: http.StatusNotFound,
+			expMsg:    "event " + otherUUID + " not found for user bob",
+		},
+		{
+			url:       "/v1/users/bob/events/XXX",
+			expStatus: http.StatusBadRequest,
+			expMsg:    "invalid UUID length: 3",
+		},
+	} {
+		req, err := http.NewRequest(http.MethodDelete, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch v.auth {
+		case "":
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		case "-":
+		default:
+			req.Header.Set("Authorization", v.auth)
+		}
+		router := v.router
+		if router == nil {
+			router = r
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		var status types.StatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+		}
+		if status.Status != v.expMsg || status.Deleted != v.expDeleted {
+			t.Errorf("(%d) expected ('%s', %d), got ('%s', %d)", i, v.expMsg,
+				v.expDeleted, status.Status, status.Deleted)
+		}
+	}
+}
+
+func TestResetEndpoint(t *testing.T) {
+	const token = "s3cret"
+	confirm := "?confirm=" + ResetConfirmation
+	for i, v := range []struct {
+		opts       []Option
+		method     string
+		query      string
+		auth       string
+		expStatus  int
+		expMsg     string
+		expDeleted int64
+	}{
+		{
+			opts:       []Option{WithAdminToken(token)},
+			method:     http.MethodPost,
+			query:      confirm,
+			auth:       "Bearer " + token,
+			expStatus:  http.StatusOK,
+			expMsg:     "database reset, 42 events deleted",
+			expDeleted: 42,
+		},
+		{
+			opts:       []Option{WithAdminToken(token)},
+			method:     http.MethodDelete,
+			query:      confirm,
+			auth:       "Bearer " + token,
+			expStatus:  http.StatusOK,
+			expMsg:     "database reset, 42 events deleted",
+			expDeleted: 42,
+		},
+		{
+			opts:      []Option{WithAdminToken(token)},
+			method:    http.MethodGet,
+			query:     confirm,
+			auth:      "Bearer " + token,
+			expStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			opts:      []Option{WithAdminToken(token)},
+			method:    http.MethodPost,
+			auth:      "Bearer " + token,
+			expStatus: http.StatusBadRequest,
+			expMsg:    "reset requires confirm=" + ResetConfirmation,
+		},
+		{
+			opts:      []Option{WithAdminToken(token)},
+			method:    http.MethodPost,
+			query:     confirm,
+			auth:      "Bearer wrong",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+		{
+			opts:      []Option{WithAdminToken(token)},
+			method:    http.MethodPost,
+			query:     confirm,
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+		{
+			opts:      []Option{WithAdminToken(token)},
+			method:    http.MethodPost,
+			query:     confirm,
+			auth:      token,
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+		{
+			method:    http.MethodPost,
+			query:     confirm,
+			auth:      "Bearer ",
+			expStatus: http.StatusForbidden,
+			expMsg:    "no admin credential is configured",
+		},
+		{
+			opts:      []Option{WithAdminToken(token), WithResetDisabled()},
+			method:    http.MethodPost,
+			query:     confirm,
+			auth:      "Bearer " + token,
+			expStatus: http.StatusNotFound,
+		},
+	} {
+		ms := &mockService{}
+		r := mux.NewRouter()
+		if err := Init(r, ms, newTestLogger(t), v.opts...); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(v.method, resetURL+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.auth != "" {
+			req.Header.Set("Authorization", v.auth)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if ms.reset != (v.expStatus == http.StatusOK) {
+			t.Errorf("(%d) expected reset %t, got %t", i, v.expStatus == http.StatusOK, ms.reset)
+		}
+		if v.expMsg == "" {
+			continue
+		}
+		var status types.StatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+		}
+		if status.Status != v.expMsg || status.Deleted != v.expDeleted {
+			t.Errorf("(%d) expected ('%s', %d), got ('%s', %d)", i, v.expMsg,
+				v.expDeleted, status.Status, status.Deleted)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := auth.Load(strings.NewReader(
+		"billing " + auth.HashKey("billing-key") + " verify\n" +
+			"support " + auth.HashKey("support-key") + " read,admin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(types.VerifyRequest{
+		Username:      "NoPredOrSucc",
+		UnixTimestamp: req1.UnixTimestamp,
+		EventUUID:     req1.EventUUID,
+		IPAddress:     req1.IPAddress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []struct {
+		method    string
+		url       string
+		key       string
+		expStatus int
+		expMsg    string
+		expClient string
+		expLogged string
+	}{
+		{method: http.MethodGet, url: statusURL, expStatus: http.StatusOK},
+		{
+			method:    http.MethodPost,
+			url:       verifyURL,
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid API key",
+		},
+		{
+			method:    http.MethodPost,
+			url:       verifyURL,
+			key:       "wrong-key",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid API key",
+		},
+		{
+			method:    http.MethodPost,
+			url:       verifyURL,
+			key:       "billing-key",
+			expStatus: http.StatusOK,
+			expClient: "billing",
+			expLogged: "billing",
+		},
+		{
+			method:    http.MethodPost,
+			url:       verifyURL,
+			key:       "support-key",
+			expStatus: http.StatusForbidden,
+			expMsg:    "client support does not have the verify scope",
+		},
+		{
+			method:    http.MethodGet,
+			url:       "/v1/users/bob/events",
+			key:       "billing-key",
+			expStatus: http.StatusForbidden,
+			expMsg:    "client billing does not have the read scope",
+		},
+		{
+			method:    http.MethodGet,
+			url:       "/v1/users/bob/events",
+			key:       "support-key",
+			expStatus: http.StatusOK,
+			expLogged: "support",
+		},
+		{
+			method:    http.MethodDelete,
+			url:       "/v1/users/bob",
+			key:       "billing-key",
+			expStatus: http.StatusForbidden,
+			expMsg:    "client billing does not have the admin scope",
+		},
+		{
+			// An admin key takes the place of the admin token.
+			method:    http.MethodPost,
+			url:       resetURL + "?confirm=" + ResetConfirmation,
+			key:       "support-key",
+			expStatus: http.StatusOK,
+			expMsg:    "database reset, 42 events deleted",
+			expLogged: "support",
+		},
+	} {
+		ms := &mockService{}
+		r := mux.NewRouter()
+		core, logs := observer.New(zap.InfoLevel)
+		if err := Init(r, ms, zap.New(core).Sugar(), WithAPIKeys(keys)); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(v.method, v.url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.key != "" {
+			req.Header.Set(APIKeyHeader, v.key)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if ms.lastReq.Client != v.expClient {
+			t.Errorf("(%d) expected client '%s', got '%s'", i, v.expClient, ms.lastReq.Client)
+		}
+		handled := logs.FilterMessage("Handled URL").All()
+		if len(handled) != 1 {
+			t.Fatalf("(%d) expected the request to be logged once, got %d", i, len(handled))
+		}
+		if logged, _ := handled[0].ContextMap()["client"].(string); logged != v.expLogged {
+			t.Errorf("(%d) expected logged client '%s', got '%s'", i, v.expLogged, logged)
+		}
+		if v.expMsg == "" {
+			continue
+		}
+		var status types.StatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+		}
+		if status.Status != v.expMsg {
+			t.Errorf("(%d) expected message '%s', got '%s'", i, v.expMsg, status.Status)
+		}
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	hv := auth.NewHMACVerifier(map[string][]string{"edge": {"edge-secret"}}, time.Minute)
+	body, err := json.Marshal(types.VerifyRequest{
+		Username:      "NoPredOrSucc",
+		UnixTimestamp: req1.UnixTimestamp,
+		EventUUID:     req1.EventUUID,
+		IPAddress:     req1.IPAddress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for i, v := range []struct {
+		method    string
+		url       string
+		secret    string
+		nonce     string
+		auth      string
+		expStatus int
+		expMsg    string
+		expClient string
+	}{
+		{url: verifyURL, secret: "edge-secret", nonce: "n1", expStatus: http.StatusOK, expClient: "edge"},
+		{
+			url:       verifyURL,
+			secret:    "edge-secret",
+			nonce:     "n1",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "nonce already used",
+		},
+		{
+			url:       verifyURL,
+			secret:    "wrong-secret",
+			nonce:     "n2",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid signature",
+		},
+		{url: verifyURL, expStatus: http.StatusUnauthorized, expMsg: "missing signature"},
+		{
+			url:       verifyURL + "?dry_run=true",
+			secret:    "edge-secret",
+			nonce:     "n3",
+			expStatus: http.StatusOK,
+			expClient: "edge",
+		},
+		{
+			// Only the verify endpoints need a signature.
+			method:    http.MethodGet,
+			url:       "/v1/users/bob/events",
+			expStatus: http.StatusOK,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       "/v1/users/bob",
+			auth:      "Bearer " + testAdminToken,
+			expStatus: http.StatusOK,
+			expMsg:    "events for user bob deleted",
+		},
+		{
+			method:    http.MethodDelete,
+			url:       "/v1/users/bob",
+			expStatus: http.StatusUnauthorized,
+			expMsg:    "invalid admin credential",
+		},
+	} {
+		ms := &mockService{}
+		r := mux.NewRouter()
+		if err := Init(r, ms, newTestLogger(t), WithHMAC(hv),
+			WithAdminToken(testAdminToken)); err != nil {
+			t.Fatal(err)
+		}
+		method := v.method
+		if method == "" {
+			method = http.MethodPost
+		}
+		req, err := http.NewRequest(method, v.url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.auth != "" {
+			req.Header.Set("Authorization", v.auth)
+		}
+		if v.secret != "" {
+			req.Header.Set(ClientHeader, "edge")
+			req.Header.Set(TimestampHeader, strconv.FormatInt(now, 10))
+			req.Header.Set(NonceHeader, v.nonce)
+			req.Header.Set(SignatureHeader, auth.Sign(v.secret, method, v.url, now, v.nonce, body))
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code, v.expStatus)
+		}
+		if ms.lastReq.Client != v.expClient {
+			t.Errorf("(%d) expected client '%s', got '%s'", i, v.expClient, ms.lastReq.Client)
+		}
+		if v.expMsg == "" {
+			continue
+		}
+		var status types.StatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+		}
+		if status.Status != v.expMsg {
+			t.Errorf("(%d) expected message '%s', got '%s'", i, v.expMsg, status.Status)
+		}
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	for i, v := range []struct {
+		reloadErr error
+		expStatus int
+		expMsg    string
+	}{
+		{expStatus: http.StatusOK, expMsg: "geolocation database reloaded"},
+		{
+			reloadErr: service.Error("open mmdb/GeoLite2-City.mmdb: no such file or directory"),
+			expStatus: http.StatusInternalServerError,
+			expMsg:    "open mmdb/GeoLite2-City.mmdb: no such file or directory",
+		},
+		{
+			reloadErr: service.Error("geolocator does not support reloading"),
+			expStatus: http.StatusInternalServerError,
+			expMsg:    "geolocator does not support reloading",
+		},
+	} {
+		ms := &mockService{reloadErr: v.reloadErr}
+		api := apiImpl{service: ms, log: newTestLogger(t)}
+		req, err := http.NewRequest(http.MethodPost, reloadURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.reloadGeoDB).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		var status types.StatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+		}
+		if status.Status != v.expMsg {
+			t.Errorf("(%d) expected message '%s', got '%s'", i, v.expMsg, status.Status)
+		}
+		if ms.reloaded != (v.reloadErr == nil) {
+			t.Errorf("(%d) unexpected reload state: %t", i, ms.reloaded)
+		}
+	}
+}
+
+// TestDenylistEndpoints runs the denylist endpoints through the router, to
+// check CIDR blocks with slashes are routed to the delete handler.
+func TestDenylistEndpoints(t *testing.T) {
+	ms := &mockService{}
+	r := mux.NewRouter()
+	if err := Init(r, ms, newTestLogger(t), WithAdminToken(testAdminToken)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range []struct {
+		method     string
+		url        string
+		body       string
+		expStatus  int
+		expEntries []string
+		expMsg     string
+	}{
+		{method: http.MethodGet, url: denyURL, expStatus: http.StatusOK, expEntries: []string{}},
+		{method: http.MethodPost, url: denyURL, body: `{"entry": "10.0.0.0/8"}`, expStatus: http.StatusCreated},
+		{method: http.MethodPost, url: denyURL, body: `{"entry": "2001:db8::/32"}`, expStatus: http.StatusCreated},
+		{
+			method:    http.MethodPost,
+			url:       denyURL,
+			body:      `{"entry": "10.0.0.0/33"}`,
+			expStatus: http.StatusBadRequest,
+			expMsg:    "invalid CIDR block: 10.0.0.0/33",
+		},
+		{
+			method:     http.MethodGet,
+			url:        denyURL,
+			expStatus:  http.StatusOK,
+			expEntries: []string{"10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			method:    http.MethodDelete,
+			url:       denyURL + "/10.0.0.0/8",
+			expStatus: http.StatusOK,
+			expMsg:    "denylist entry 10.0.0.0/8 removed",
+		},
+		{
+			method:    http.MethodDelete,
+			url:       denyURL + "/10.0.0.0/8",
+			expStatus: http.StatusNotFound,
+			expMsg:    "denylist entry 10.0.0.0/8 not found",
+		},
+		{
+			method:     http.MethodGet,
+			url:        denyURL,
+			expStatus:  http.StatusOK,
+			expEntries: []string{"2001:db8::/32"},
+		},
+	} {
+		req, err := http.NewRequest(v.method, v.url, strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d: %s", i, rr.Code, v.expStatus, rr.Body)
+		}
+		if v.expEntries != nil {
+			var resp types.DenylistResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("(%d) can't unmarshal denylist: %v", i, err)
+			}
+			var entries []string
+			for _, e := range resp.Entries {
+				entries = append(entries, e.Entry)
+			}
+			if len(entries) != len(v.expEntries) ||
+				(len(entries) > 0 && !reflect.DeepEqual(entries, v.expEntries)) {
+				t.Errorf("(%d) expected entries %v, got %v", i, v.expEntries, entries)
+			}
+		}
+		if v.expMsg != "" {
+			var status types.StatusResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+				t.Fatalf("(%d) can't unmarshal status: %v", i, err)
+			}
+			if status.Status != v.expMsg {
+				t.Errorf("(%d) expected message '%s', got '%s'", i, v.expMsg, status.Status)
+			}
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	r := mux.NewRouter()
+	if err := Init(r, &mockService{}, newTestLogger(t), WithAdminToken(testAdminToken)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters are global, so only the changes are checked.  The route
+	// is the template, whatever the user name.
+	deleted := httpRequests.WithLabelValues(usersURL, http.MethodDelete, "200")
+	notFound := httpRequests.WithLabelValues(usersURL, http.MethodDelete, "404")
+	before := []float64{testutil.ToFloat64(deleted), testutil.ToFloat64(notFound)}
+	for _, url := range []string{"/v1/users/bob", "/v1/users/alice", "/v1/users/bob"} {
+		req, err := http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if n := testutil.ToFloat64(deleted) - before[0]; n != 2 {
+		t.Errorf("expected 2 successful deletes, got %v", n)
+	}
+	if n := testutil.ToFloat64(notFound) - before[1]; n != 1 {
+		t.Errorf("expected 1 failed delete, got %v", n)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, metricsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	body := rr.Body.String()
+	for _, exp := range []string{
+		`ipverify_http_requests_total{code="404",method="DELETE",route="/v1/users/{username}"}`,
+		`ipverify_http_request_duration_seconds_count{code="200",method="DELETE",route="/v1/users/{username}"}`,
+		`ipverify_verify_outcomes_total{outcome="suspicious_preceding"}`,
+	} {
+		if !strings.Contains(body, exp) {
+			t.Errorf("expected metrics to contain %s", exp)
+		}
+	}
+}
+
 func newTestLogger(t *testing.T) *zap.SugaredLogger {
 	config := zap.NewProductionConfig()
 	config.OutputPaths = []string{"/dev/null"}
@@ -236,10 +1261,18 @@ func newTestLogger(t *testing.T) *zap.SugaredLogger {
 // the request to determine the response type, for example, wehether the
 // response incldues a previous and/or subsequent event.
 type mockService struct {
+	reloaded  bool
+	reloadErr error
+	denylist  []types.DenylistEntry
+	lastReq   types.VerifyRequest
+	lastQuery types.EventQuery
+	reset     bool
+	degraded  bool
 }
 
-func (ms *mockService) VerifyIP(req types.VerifyRequest) (*types.VerifyResponse, error) {
-	var resp types.VerifyResponse
+func (ms *mockService) VerifyIP(ctx context.Context, req types.VerifyRequest) (*types.VerifyResponse, error) {
+	ms.lastReq = req
+	resp := types.VerifyResponse{DryRun: req.DryRun}
 
 	switch req.Username {
 	case "NoPredOrSucc":
@@ -258,11 +1291,125 @@ func (ms *mockService) VerifyIP(req types.VerifyRequest) (*types.VerifyResponse,
 		resp.PrecedingIPAccess = &validGeoEvent
 		resp.SubsequentIPAccess = &validGeoEvent2
 		return &resp, nil
+	case "Slow":
+		<-ctx.Done()
+		return nil, fmt.Errorf("add record to store: %w", ctx.Err())
 	default:
 		return nil, nil
 	}
 }
 
-func (ms *mockService) ResetStore() error {
+func (ms *mockService) VerifyBatch(ctx context.Context, reqs []types.VerifyRequest) []service.BatchResult {
+	results := make([]service.BatchResult, len(reqs))
+	for i, req := range reqs {
+		switch req.Username {
+		case "Duplicate":
+			results[i].Err = errors.New("add record to store: UNIQUE constraint failed: requests.UUID")
+		case "Broken":
+			results[i].Err = service.Error("database is locked")
+		default:
+			results[i].Response, results[i].Err = ms.VerifyIP(ctx, req)
+		}
+	}
+	return results
+}
+
+func (ms *mockService) GetUserEvents(ctx context.Context, username string,
+	query types.EventQuery) (*types.UserEventsResponse, error) {
+	ms.lastQuery = query
+	return &types.UserEventsResponse{
+		Username: username,
+		Total:    1,
+		Limit:    query.Limit,
+		Offset:   query.Offset,
+		Events: []types.UserEvent{{
+			EventUUID:    req1.EventUUID,
+			IP:           req1.IPAddress,
+			Timestamp:    req1.UnixTimestamp,
+			Geo:          validCurrGeo,
+			FromPrevious: &validGeoEvent2,
+		}},
+	}, nil
+}
+
+func (ms *mockService) DeleteUser(ctx context.Context, username string) (int64, error) {
+	if username != "bob" {
+		return 0, service.NotFoundError(fmt.Sprintf("no events found for user %s", username))
+	}
+	return 3, nil
+}
+
+func (ms *mockService) DeleteEvent(ctx context.Context, username string, uuid string) (int64, error) {
+	if username != "bob" || uuid != req1.EventUUID {
+		return 0, service.NotFoundError(fmt.Sprintf("event %s not found for user %s", uuid, username))
+	}
+	return 1, nil
+}
+
+func (ms *mockService) PruneStats() *types.PruneStats {
 	return nil
 }
+
+func (ms *mockService) ResetStore(ctx context.Context) (int64, error) {
+	ms.reset = true
+	return 42, nil
+}
+
+func (ms *mockService) GetDenylist(ctx context.Context) ([]types.DenylistEntry, error) {
+	return ms.denylist, nil
+}
+
+func (ms *mockService) AddDenylistEntry(ctx context.Context, entry types.DenylistEntry) (types.DenylistEntry, error) {
+	if net.ParseIP(entry.Entry) == nil {
+		if _, _, err := net.ParseCIDR(entry.Entry); err != nil {
+			return entry, fmt.Errorf("invalid CIDR block: %s", entry.Entry)
+		}
+	}
+	entry.Source = types.DenylistAPI
+	ms.denylist = append(ms.denylist, entry)
+	return entry, nil
+}
+
+func (ms *mockService) RemoveDenylistEntry(ctx context.Context, entry string) error {
+	for i, e := range ms.denylist {
+		if e.Entry == entry {
+			ms.denylist = append(ms.denylist[:i], ms.denylist[i+1:]...)
+			return nil
+		}
+	}
+	return service.NotFoundError(fmt.Sprintf("denylist entry %s not found", entry))
+}
+
+func (ms *mockService) ReloadGeoDB() error {
+	if ms.reloadErr != nil {
+		return ms.reloadErr
+	}
+	ms.reloaded = true
+	return nil
+}
+
+func (ms *mockService) Ready(ctx context.Context) types.ReadyResponse {
+	resp := types.ReadyResponse{
+		Status: types.Ready,
+		Store: types.StoreReadiness{
+			Status:      types.Ready,
+			StoreCounts: types.StoreCounts{Events: 3, Denylist: 1},
+		},
+		GeoDB: types.GeoDBReadiness{
+			Status:    types.Ready,
+			CanaryIP:  "81.2.69.142",
+			BuildDate: "2019-06-11T22:20:14Z",
+			GeoDBInfo: ms.GeoDBInfo(),
+		},
+	}
+	if ms.degraded {
+		resp.Status = types.Degraded
+		resp.Store = types.StoreReadiness{Status: types.Degraded,
+			Error: "sql: database is closed"}
+	}
+	return resp
+}
+
+func (ms *mockService) GeoDBInfo() types.GeoDBInfo {
+	return types.GeoDBInfo{Type: "GeoLite2-City", BuildEpoch: 1560291614}
+}
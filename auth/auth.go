@@ -0,0 +1,148 @@
+// Package auth implements API key authentication.  Keys are only stored
+// as SHA-256 hashes, so the key file does not need to be kept secret, and
+// each key maps to a named client with a set of scopes.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Scope is a permission granted to a client.
+type Scope string
+
+// The supported scopes.
+const (
+	ScopeVerify Scope = "verify" // verify logins
+	ScopeRead   Scope = "read"   // read login history and the denylist
+	ScopeAdmin  Scope = "admin"  // delete data and manage the service
+)
+
+// ParseScope converts a string to a Scope, returning an error if the scope
+// is not supported.
+func ParseScope(s string) (Scope, error) {
+	switch sc := Scope(strings.ToLower(s)); sc {
+	case ScopeVerify, ScopeRead, ScopeAdmin:
+		return sc, nil
+	default:
+		return "", fmt.Errorf("invalid scope: %s", s)
+	}
+}
+
+// Client is the holder of an API key.
+type Client struct {
+	Name   string
+	Scopes []Scope
+}
+
+// Has reports whether the client was granted the scope.
+func (c Client) Has(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore maps the hashes of API keys to clients.
+type KeyStore struct {
+	keys map[string]Client
+}
+
+// HashKey returns the hex encoded SHA-256 hash of an API key, as stored in
+// the key file.
+func HashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Load creates a KeyStore from the entries read from r.  There is one key
+// per line, with the client name, the hash of the key and a comma separated
+// list of scopes, separated by whitespace.  Anything following a '#' is a
+// comment, and blank lines are ignored.
+func Load(r io.Reader) (*KeyStore, error) {
+	ks := &KeyStore{keys: make(map[string]Client)}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected client name, key hash and scopes", lineNo)
+		}
+		hash := strings.ToLower(fields[1])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid SHA-256 key hash: %s", lineNo, fields[1])
+		}
+		if _, ok := ks.keys[hash]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key for client %s", lineNo, fields[0])
+		}
+		client := Client{Name: fields[0]}
+		for _, s := range strings.Split(fields[2], ",") {
+			scope, err := ParseScope(s)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			client.Scopes = append(client.Scopes, scope)
+		}
+		ks.keys[hash] = client
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// LoadFile creates a KeyStore from the entries in the file.
+func LoadFile(path string) (*KeyStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ks, err := Load(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ks, nil
+}
+
+// Authenticate returns the client the API key belongs to, if any.
+func (ks *KeyStore) Authenticate(key string) (Client, bool) {
+	if key == "" {
+		return Client{}, false
+	}
+	client, ok := ks.keys[HashKey(key)]
+	return client, ok
+}
+
+// Len returns the number of keys.
+func (ks *KeyStore) Len() int {
+	return len(ks.keys)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the authenticated client.
+func NewContext(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, client)
+}
+
+// FromContext returns the authenticated client from the context, if any.
+func FromContext(ctx context.Context) (Client, bool) {
+	client, ok := ctx.Value(contextKey{}).(Client)
+	return client, ok
+}
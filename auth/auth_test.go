@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	keys := `# client  key hash  scopes
+billing  ` + HashKey("billing-key") + `  verify
+support  ` + strings.ToUpper(HashKey("support-key")) + `  read,ADMIN   # on call
+
+`
+	ks, err := Load(strings.NewReader(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Len() != 2 {
+		t.Errorf("expected 2 keys, got %d", ks.Len())
+	}
+
+	for i, v := range []struct {
+		key       string
+		expFound  bool
+		expClient Client
+	}{
+		{key: "billing-key", expFound: true, expClient: Client{Name: "billing",
+			Scopes: []Scope{ScopeVerify}}},
+		{key: "support-key", expFound: true, expClient: Client{Name: "support",
+			Scopes: []Scope{ScopeRead, ScopeAdmin}}},
+		{key: "other-key"},
+		{key: ""},
+	} {
+		client, found := ks.Authenticate(v.key)
+		if found != v.expFound || !reflect.DeepEqual(client, v.expClient) {
+			t.Errorf("(%d) expected (%+v, %t), got (%+v, %t)", i, v.expClient, v.expFound,
+				client, found)
+		}
+	}
+
+	for i, v := range []struct {
+		keys      string
+		expErrStr string
+	}{
+		{keys: "billing verify", expErrStr: "line 1: expected client name, key hash and scopes"},
+		{keys: "billing abc verify", expErrStr: "line 1: invalid SHA-256 key hash: abc"},
+		{
+			keys:      "billing " + HashKey("k") + " verify,write",
+			expErrStr: "line 1: invalid scope: write",
+		},
+		{
+			keys:      "a " + HashKey("k") + " verify\nb " + HashKey("k") + " read",
+			expErrStr: "line 2: duplicate key for client b",
+		},
+	} {
+		_, err := Load(strings.NewReader(v.keys))
+		if err == nil || err.Error() != v.expErrStr {
+			t.Errorf("(%d) expected error '%s', got '%v'", i, v.expErrStr, err)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("expected no client in empty context")
+	}
+	client := Client{Name: "billing", Scopes: []Scope{ScopeVerify}}
+	got, ok := FromContext(NewContext(context.Background(), client))
+	if !ok || !reflect.DeepEqual(got, client) {
+		t.Errorf("expected %+v, got (%+v, %t)", client, got, ok)
+	}
+	if !got.Has(ScopeVerify) || got.Has(ScopeAdmin) {
+		t.Error("unexpected scopes")
+	}
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSecretsPerClient is the number of HMAC secrets a client may have at
+// once, so a secret can be rotated without downtime: the new secret is
+// added, the client switches to it, and the old one is removed.
+const MaxSecretsPerClient = 2
+
+// maxNonceLen limits the size of the replay cache entries.
+const maxNonceLen = 64
+
+// Signature verification errors.
+var (
+	ErrUnknownClient   = errors.New("unknown client")
+	ErrBadSignature    = errors.New("invalid signature")
+	ErrClockSkew       = errors.New("signature timestamp outside the allowed clock skew")
+	ErrReplayedRequest = errors.New("nonce already used")
+)
+
+// LoadSecrets reads the HMAC shared secrets from r.  There is one secret
+// per line, with the client name followed by the secret, separated by
+// whitespace, and a client may appear on up to MaxSecretsPerClient lines.
+// Anything following a '#' is a comment, and blank lines are ignored.
+func LoadSecrets(r io.Reader) (map[string][]string, error) {
+	secrets := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected client name and secret", lineNo)
+		}
+		if len(secrets[fields[0]]) == MaxSecretsPerClient {
+			return nil, fmt.Errorf("line %d: client %s has more than %d secrets", lineNo,
+				fields[0], MaxSecretsPerClient)
+		}
+		secrets[fields[0]] = append(secrets[fields[0]], fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// LoadSecretsFile reads the HMAC shared secrets from the file.
+func LoadSecretsFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets, err := LoadSecrets(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return secrets, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a request.  The
+// signed string is the method, the request URI (path and query), the Unix
+// timestamp, the nonce and the hex encoded SHA-256 hash of the body, each
+// on its own line.
+func Sign(secret string, method, uri string, timestamp int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s", method, uri, timestamp, nonce,
+		hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HMACVerifier verifies signed requests.  Requests must be signed within
+// the maximum clock skew of the current time, and each nonce may only be
+// used once per client.  The nonces are remembered for long enough that a
+// request can't be replayed once they are forgotten.
+type HMACVerifier struct {
+	sync.Mutex
+	secrets   map[string][]string
+	maxSkew   time.Duration
+	nonces    map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewHMACVerifier creates an HMACVerifier for the clients' secrets.
+func NewHMACVerifier(secrets map[string][]string, maxSkew time.Duration) *HMACVerifier {
+	return &HMACVerifier{
+		secrets: secrets,
+		maxSkew: maxSkew,
+		nonces:  make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Verify checks the signature of a request, returning the client, which
+// only has the verify scope.
+func (hv *HMACVerifier) Verify(client, method, uri, timestamp, nonce, signature string,
+	body []byte) (Client, error) {
+	secrets, ok := hv.secrets[client]
+	if !ok {
+		return Client{}, ErrUnknownClient
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Client{}, fmt.Errorf("invalid signature timestamp: %s", timestamp)
+	}
+	if nonce == "" || len(nonce) > maxNonceLen {
+		return Client{}, fmt.Errorf("nonce must be 1 to %d characters", maxNonceLen)
+	}
+	now := hv.now()
+	if d := now.Sub(time.Unix(ts, 0)); d > hv.maxSkew || d < -hv.maxSkew {
+		return Client{}, ErrClockSkew
+	}
+
+	// Either of the client's secrets may have been used.
+	valid := false
+	for _, s := range secrets {
+		if hmac.Equal([]byte(signature), []byte(Sign(s, method, uri, ts, nonce, body))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return Client{}, ErrBadSignature
+	}
+
+	// Only a correctly signed request uses up the nonce, so nonces can't
+	// be burned by anyone without the secret.
+	hv.Lock()
+	defer hv.Unlock()
+	hv.sweep(now)
+	key := client + "\n" + nonce
+	if _, ok := hv.nonces[key]; ok {
+		return Client{}, ErrReplayedRequest
+	}
+	hv.nonces[key] = time.Unix(ts, 0).Add(hv.maxSkew)
+	return Client{Name: client, Scopes: []Scope{ScopeVerify}}, nil
+}
+
+// sweep forgets the nonces of requests that are now too old to be
+// accepted anyway, at most once per skew interval.
+func (hv *HMACVerifier) sweep(now time.Time) {
+	if now.Sub(hv.lastSweep) < hv.maxSkew {
+		return
+	}
+	for k, exp := range hv.nonces {
+		if now.After(exp) {
+			delete(hv.nonces, k)
+		}
+	}
+	hv.lastSweep = now
+}
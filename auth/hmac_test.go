@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	secrets, err := LoadSecrets(strings.NewReader(`# client  secret
+edge   old-secret
+edge   new-secret   # rotating
+other  other-secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string][]string{
+		"edge":  {"old-secret", "new-secret"},
+		"other": {"other-secret"},
+	}
+	if !reflect.DeepEqual(secrets, exp) {
+		t.Errorf("expected %v, got %v", exp, secrets)
+	}
+
+	for i, v := range []struct {
+		secrets   string
+		expErrStr string
+	}{
+		{secrets: "edge", expErrStr: "line 1: expected client name and secret"},
+		{secrets: "edge a\nedge b\nedge c", expErrStr: "line 3: client edge has more than 2 secrets"},
+	} {
+		_, err := LoadSecrets(strings.NewReader(v.secrets))
+		if err == nil || err.Error() != v.expErrStr {
+			t.Errorf("(%d) expected error '%s', got '%v'", i, v.expErrStr, err)
+		}
+	}
+}
+
+func TestHMACVerify(t *testing.T) {
+	now := time.Unix(1560763193, 0)
+	hv := NewHMACVerifier(map[string][]string{"edge": {"old-secret", "new-secret"}},
+		5*time.Minute)
+	hv.now = func() time.Time { return now }
+
+	const uri = "/v1/verify?dry_run=true"
+	body := []byte(`{"username": "bob"}`)
+	ts := now.Unix()
+	for i, v := range []struct {
+		client    string
+		secret    string
+		uri       string
+		timestamp int64
+		nonce     string
+		body      []byte
+		expErr    string
+	}{
+		{client: "edge", secret: "old-secret", timestamp: ts, nonce: "n1"},
+		{client: "edge", secret: "new-secret", timestamp: ts - 299, nonce: "n2"},
+		{client: "edge", secret: "new-secret", timestamp: ts, nonce: "n1", expErr: ErrReplayedRequest.Error()},
+		{client: "edge", secret: "new-secret", timestamp: ts + 301, nonce: "n3", expErr: ErrClockSkew.Error()},
+		{client: "edge", secret: "new-secret", timestamp: ts - 301, nonce: "n3", expErr: ErrClockSkew.Error()},
+		{client: "edge", secret: "wrong-secret", timestamp: ts, nonce: "n3", expErr: ErrBadSignature.Error()},
+		{
+			client:    "edge",
+			secret:    "new-secret",
+			uri:       "/v1/verify",
+			timestamp: ts,
+			nonce:     "n3",
+			expErr:    ErrBadSignature.Error(),
+		},
+		{
+			client:    "edge",
+			secret:    "new-secret",
+			timestamp: ts,
+			nonce:     "n3",
+			body:      []byte(`{"username": "eve"}`),
+			expErr:    ErrBadSignature.Error(),
+		},
+		{client: "other", secret: "new-secret", timestamp: ts, nonce: "n3", expErr: ErrUnknownClient.Error()},
+		{
+			client:    "edge",
+			secret:    "new-secret",
+			timestamp: ts,
+			nonce:     strings.Repeat("n", 65),
+			expErr:    "nonce must be 1 to 64 characters",
+		},
+	} {
+		sig := Sign(v.secret, "POST", uri, v.timestamp, v.nonce, body)
+		reqURI, reqBody := uri, body
+		if v.uri != "" {
+			reqURI = v.uri
+		}
+		if v.body != nil {
+			reqBody = v.body
+		}
+		client, err := hv.Verify(v.client, "POST", reqURI, strconv.FormatInt(v.timestamp, 10),
+			v.nonce, sig, reqBody)
+		if v.expErr != "" {
+			if err == nil || err.Error() != v.expErr {
+				t.Errorf("(%d) expected error '%s', got '%v'", i, v.expErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", i, err)
+		}
+		if client.Name != v.client || !client.Has(ScopeVerify) || client.Has(ScopeRead) {
+			t.Errorf("(%d) unexpected client %+v", i, client)
+		}
+	}
+
+	// Nonces are forgotten once their requests would be rejected anyway.
+	if len(hv.nonces) != 2 {
+		t.Errorf("expected 2 nonces, got %d", len(hv.nonces))
+	}
+	now = now.Add(10 * time.Minute)
+	sig := Sign("new-secret", "POST", uri, now.Unix(), "n4", body)
+	if _, err := hv.Verify("edge", "POST", uri, strconv.FormatInt(now.Unix(), 10), "n4",
+		sig, body); err != nil {
+		t.Fatal(err)
+	}
+	if len(hv.nonces) != 1 {
+		t.Errorf("expected expired nonces to be swept, got %d", len(hv.nonces))
+	}
+}
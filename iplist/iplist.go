@@ -0,0 +1,257 @@
+// Package iplist implements sets of IP addresses and CIDR blocks, such as
+// Tor exit lists or allow and deny lists.  The sets are stored as binary
+// tries keyed on the address bits, so a lookup costs at most one step per
+// bit of the address, regardless of how many prefixes are in the set.
+package iplist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// node is a node in the binary trie.  A node is terminal if the prefix
+// formed by the path to it is in the set.
+type node struct {
+	child    [2]*node
+	terminal bool
+	entry    string
+}
+
+// Set is a set of IPv4 and IPv6 addresses and CIDR blocks.  It is safe for
+// concurrent use.
+type Set struct {
+	sync.RWMutex
+	v4    *node
+	v6    *node
+	count int
+}
+
+// New creates an empty Set.
+func New() *Set {
+	return &Set{v4: &node{}, v6: &node{}}
+}
+
+// Parse converts an IP address or CIDR block to its canonical form.  Single
+// addresses are treated as full-length prefixes, and are returned without
+// a prefix length.  IPv4-mapped IPv6 addresses and blocks are converted to
+// IPv4.
+func Parse(entry string) (*net.IPNet, string, error) {
+	entry = strings.TrimSpace(entry)
+	var ipn *net.IPNet
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid CIDR block: %s", entry)
+		}
+		ipn = n
+	} else {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, "", fmt.Errorf("invalid IP address: %s", entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ipn = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		} else {
+			ipn = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+	}
+	// IPv4-mapped IPv6 blocks are kept in the IPv4 trie, since that is
+	// where their addresses are looked up.
+	if ip4 := ipn.IP.To4(); ip4 != nil {
+		if ones, bits := ipn.Mask.Size(); bits == 8*net.IPv6len {
+			ipn.Mask = net.CIDRMask(ones-96, 8*net.IPv4len)
+		}
+		ipn.IP = ip4
+	}
+	if ones, bits := ipn.Mask.Size(); ones == bits {
+		return ipn, ipn.IP.String(), nil
+	}
+	return ipn, ipn.String(), nil
+}
+
+// Add adds an IP address or CIDR block to the set.
+func (s *Set) Add(entry string) error {
+	ipn, canon, err := Parse(entry)
+	if err != nil {
+		return err
+	}
+	ones, _ := ipn.Mask.Size()
+
+	s.Lock()
+	defer s.Unlock()
+	n := s.root(ipn.IP)
+	for i := 0; i < ones; i++ {
+		b := bit(ipn.IP, i)
+		if n.child[b] == nil {
+			n.child[b] = &node{}
+		}
+		n = n.child[b]
+	}
+	if !n.terminal {
+		s.count++
+	}
+	n.terminal = true
+	n.entry = canon
+	return nil
+}
+
+// Remove removes an IP address or CIDR block from the set, returning
+// whether it was present.  Note only the exact entry is removed, not any
+// prefixes contained within it.
+func (s *Set) Remove(entry string) (bool, error) {
+	ipn, _, err := Parse(entry)
+	if err != nil {
+		return false, err
+	}
+	ones, _ := ipn.Mask.Size()
+
+	s.Lock()
+	defer s.Unlock()
+	n := s.root(ipn.IP)
+	for i := 0; i < ones && n != nil; i++ {
+		n = n.child[bit(ipn.IP, i)]
+	}
+	if n == nil || !n.terminal {
+		return false, nil
+	}
+	n.terminal = false
+	n.entry = ""
+	s.count--
+	return true, nil
+}
+
+// Has reports whether the exact IP address or CIDR block is an entry in
+// the set, as opposed to Contains, which checks for a containing entry.
+func (s *Set) Has(entry string) bool {
+	ipn, _, err := Parse(entry)
+	if err != nil {
+		return false
+	}
+	ones, _ := ipn.Mask.Size()
+
+	s.RLock()
+	defer s.RUnlock()
+	n := s.root(ipn.IP)
+	for i := 0; i < ones && n != nil; i++ {
+		n = n.child[bit(ipn.IP, i)]
+	}
+	return n != nil && n.terminal
+}
+
+// Contains reports whether the IP address is in the set, returning the
+// most specific entry that contains it.
+func (s *Set) Contains(ip net.IP) (string, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	var match string
+	var found bool
+	n := s.root(ip)
+	for i := 0; n != nil; i++ {
+		if n.terminal {
+			match, found = n.entry, true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.child[bit(ip, i)]
+	}
+	return match, found
+}
+
+// ContainsString is like Contains, but takes the IP address as a string.
+// An invalid address is never in the set.
+func (s *Set) ContainsString(ip string) (string, bool) {
+	ipn := net.ParseIP(ip)
+	if ipn == nil {
+		return "", false
+	}
+	return s.Contains(ipn)
+}
+
+// Len returns the number of entries in the set.
+func (s *Set) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.count
+}
+
+// Entries returns all the entries in the set, IPv4 before IPv6 and
+// otherwise in address order.
+func (s *Set) Entries() []string {
+	s.RLock()
+	defer s.RUnlock()
+	entries := make([]string, 0, s.count)
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == nil {
+			return
+		}
+		if n.terminal {
+			entries = append(entries, n.entry)
+		}
+		walk(n.child[0])
+		walk(n.child[1])
+	}
+	walk(s.v4)
+	walk(s.v6)
+	return entries
+}
+
+// Load adds the entries read from r to the set.  There is one entry per
+// line, and anything following a '#' is a comment.  Blank lines are
+// ignored, as is anything following the entry on a line, so lists with
+// extra columns may be used as is.
+func (s *Set) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := s.Add(fields[0]); err != nil {
+			return fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadFile creates a set from the entries in the file.
+func LoadFile(path string) (*Set, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := New()
+	if err := s.Load(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// root returns the trie for the address family of the IP address.
+func (s *Set) root(ip net.IP) *node {
+	if len(ip) == net.IPv4len {
+		return s.v4
+	}
+	return s.v6
+}
+
+// bit returns the i'th most significant bit of the IP address.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,142 @@
+package iplist
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for i, v := range []struct {
+		entry     string
+		expCanon  string
+		expErrStr string
+	}{
+		{entry: "10.1.2.3", expCanon: "10.1.2.3"},
+		{entry: "10.1.2.3/8", expCanon: "10.0.0.0/8"},
+		{entry: " 192.168.1.0/24 ", expCanon: "192.168.1.0/24"},
+		{entry: "10.1.2.3/32", expCanon: "10.1.2.3"},
+		{entry: "2001:0db8::0001", expCanon: "2001:db8::1"},
+		{entry: "2001:db8::/32", expCanon: "2001:db8::/32"},
+		{entry: "::ffff:10.1.2.3", expCanon: "10.1.2.3"},
+		{entry: "::ffff:10.0.0.0/104", expCanon: "10.0.0.0/8"},
+		{entry: "::ffff:10.1.2.3/128", expCanon: "10.1.2.3"},
+		{entry: "::ffff:0:0/96", expCanon: "0.0.0.0/0"},
+		{entry: "::ffff:0:0/95", expCanon: "::fffe:0:0/95"},
+		{entry: "10.1.2", expErrStr: "invalid IP address: 10.1.2"},
+		{entry: "10.1.2.3/33", expErrStr: "invalid CIDR block: 10.1.2.3/33"},
+	} {
+		_, canon, err := Parse(v.entry)
+		if err != nil {
+			if v.expErrStr == "" {
+				t.Errorf("(%d) expected no error, got %v", i, err)
+			} else if err.Error() != v.expErrStr {
+				t.Errorf("(%d) expected error '%s', got '%s'", i, v.expErrStr, err)
+			}
+			continue
+		}
+		if canon != v.expCanon {
+			t.Errorf("(%d) expected canonical entry %s, got %s", i, v.expCanon, canon)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	s := New()
+	for _, e := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.7",
+		"2001:db8::/32", "2001:db8:1::/48", "0.0.0.0/1", "::ffff:172.16.0.0/108"} {
+		if err := s.Add(e); err != nil {
+			t.Fatalf("error adding %s: %v", e, err)
+		}
+	}
+	if s.Len() != 7 {
+		t.Errorf("expected 7 entries, got %d", s.Len())
+	}
+
+	for i, v := range []struct {
+		ip       string
+		expMatch string
+		expFound bool
+	}{
+		{ip: "10.2.3.4", expMatch: "10.0.0.0/8", expFound: true},
+		{ip: "10.1.3.4", expMatch: "10.1.0.0/16", expFound: true},
+		{ip: "192.168.1.7", expMatch: "192.168.1.7", expFound: true},
+		{ip: "192.168.1.8"},
+		{ip: "127.0.0.1", expMatch: "0.0.0.0/1", expFound: true},
+		{ip: "172.17.0.1", expMatch: "172.16.0.0/12", expFound: true},
+		{ip: "::ffff:172.17.0.1", expMatch: "172.16.0.0/12", expFound: true},
+		{ip: "172.32.0.1"},
+		{ip: "::ffff:192.168.1.7", expMatch: "192.168.1.7", expFound: true},
+		{ip: "2001:db8:2::1", expMatch: "2001:db8::/32", expFound: true},
+		{ip: "2001:db8:1::1", expMatch: "2001:db8:1::/48", expFound: true},
+		{ip: "2001:db9::1"},
+		{ip: "bogus"},
+	} {
+		match, found := s.ContainsString(v.ip)
+		if found != v.expFound || match != v.expMatch {
+			t.Errorf("(%d) %s: expected (%s, %t), got (%s, %t)", i, v.ip,
+				v.expMatch, v.expFound, match, found)
+		}
+	}
+
+	if !s.Has("10.1.0.0/16") || s.Has("10.1.0.0/17") || s.Has("10.1.2.3") {
+		t.Error("unexpected exact entry membership")
+	}
+
+	// Removing an entry exposes the less specific one.
+	if ok, err := s.Remove("10.1.0.0/16"); err != nil || !ok {
+		t.Fatalf("expected remove to succeed, got (%t, %v)", ok, err)
+	}
+	if ok, _ := s.Remove("10.1.0.0/16"); ok {
+		t.Error("expected second remove to report not found")
+	}
+	if match, _ := s.ContainsString("10.1.3.4"); match != "10.0.0.0/8" {
+		t.Errorf("expected 10.0.0.0/8 after remove, got %s", match)
+	}
+	if s.Len() != 6 {
+		t.Errorf("expected 6 entries, got %d", s.Len())
+	}
+	expEntries := []string{"0.0.0.0/1", "10.0.0.0/8", "172.16.0.0/12", "192.168.1.7",
+		"2001:db8::/32", "2001:db8:1::/48"}
+	if entries := s.Entries(); !reflect.DeepEqual(entries, expEntries) {
+		t.Errorf("expected entries %v, got %v", expEntries, entries)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	list := `# Tor exit nodes
+185.220.101.1
+185.220.102.0/24   # a whole block
+
+2a0b:f4c2::/40 extra columns are ignored
+`
+	s := New()
+	if err := s.Load(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries, got %d", s.Len())
+	}
+	if _, found := s.ContainsString("185.220.102.9"); !found {
+		t.Error("expected 185.220.102.9 to be found")
+	}
+
+	err := New().Load(strings.NewReader("10.0.0.1\nnot-an-ip\n"))
+	if err == nil || err.Error() != "line 2: invalid IP address: not-an-ip" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	s := New()
+	for i := 0; i < 50000; i++ {
+		s.Add(fmt.Sprintf("%d.%d.%d.0/24", 1+i/65536, (i/256)%256, i%256))
+	}
+	ip := net.ParseIP("1.100.200.17")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Contains(ip)
+	}
+}
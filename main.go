@@ -4,18 +4,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gdotgordon/ipverify/api"
+	"github.com/gdotgordon/ipverify/auth"
+	"github.com/gdotgordon/ipverify/iplist"
 	"github.com/gdotgordon/ipverify/service"
 	"github.com/gdotgordon/ipverify/store"
+	"github.com/gdotgordon/ipverify/types"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
@@ -23,11 +31,39 @@ import (
 type cleanupTask func()
 
 var (
-	portNum         int    // listen port
-	logLevel        string // zap log level
-	timeout         int    // server timeout in seconds
-	maxMindFilepath string // location of Maxmind db file
-	dbFilePath      string // location of SQLite3 db
+	portNum         int     // listen port
+	logLevel        string  // zap log level
+	timeout         int     // server timeout in seconds
+	requestTimeout  int     // request handling deadline in seconds
+	maxMindFilepath string  // location of Maxmind db file
+	maxMindPoll     int     // Maxmind db file poll interval in seconds
+	asnFilepath     string  // location of Maxmind ASN db file
+	sameASNFactor   float64 // speed threshold multiplier for same-ASN logins
+	anonFilepath    string  // location of Maxmind Anonymous-IP db file
+	proxyListPath   string  // location of anonymous proxy address list
+	hostingListPath string  // location of hosting provider address list
+	torListPath     string  // location of Tor exit node address list
+	trustedPath     string  // location of trusted network list
+	trustMode       string  // treatment of events from trusted networks
+	denylistPath    string  // location of denylist
+	denylistPoll    int     // denylist reload interval in seconds
+	retentionDays   int     // days to keep events
+	maxUserEvents   int     // maximum events kept per user
+	pruneInterval   int     // store prune interval in seconds
+	adminToken      string  // credential for destructive admin endpoints
+	apiKeysPath     string  // location of API key file
+	hmacPath        string  // location of HMAC secrets file
+	hmacSkew        int     // allowed clock skew for signed requests in seconds
+	disableReset    bool    // remove the reset endpoint
+	locale          string  // locale for place names
+	canaryIP        string  // address looked up by the readiness check
+	storeDriver     string  // store implementation
+	dbFilePath      string  // location of SQLite3 db
+	dsn             string  // PostgreSQL connection string
+	snapshotPath    string  // location of the memory store's snapshot
+	maxSpeed        float64 // suspicious-speed threshold
+	speedUnit       string  // unit of the speed thresholds
+	groupMaxSpeed   string  // per user group speed thresholds
 )
 
 func init() {
@@ -35,10 +71,66 @@ func init() {
 	flag.StringVar(&logLevel, "log", "production",
 		"log level: 'production', 'development'")
 	flag.IntVar(&timeout, "timeout", 30, "server timeout (seconds)")
+	flag.IntVar(&requestTimeout, "request-timeout", 10,
+		"deadline (seconds) for handling a request, 0 for none")
 	flag.StringVar(&maxMindFilepath, "mmdb", "mmdb/GeoLite2-City.mmdb",
 		"location of MaxMind DB file")
+	flag.StringVar(&asnFilepath, "asn-mmdb", "",
+		"location of optional MaxMind ASN or ISP DB file")
+	flag.StringVar(&anonFilepath, "anon-mmdb", "",
+		"location of optional MaxMind Anonymous-IP DB file")
+	flag.StringVar(&proxyListPath, "proxy-list", "",
+		"location of optional file listing anonymous proxy IPs and CIDRs")
+	flag.StringVar(&hostingListPath, "hosting-list", "",
+		"location of optional file listing hosting provider IPs and CIDRs")
+	flag.StringVar(&torListPath, "tor-list", "",
+		"location of optional file listing Tor exit node IPs and CIDRs")
+	flag.StringVar(&trustedPath, "trusted-list", "",
+		"location of optional file listing trusted IPs and CIDRs, e.g. corporate VPN egress")
+	flag.StringVar(&trustMode, "trusted-mode", string(service.TrustExclude),
+		"treatment of logins from trusted networks: 'exclude', 'never-flag'")
+	flag.StringVar(&denylistPath, "denylist", "",
+		"location of optional file listing IPs and CIDRs whose logins are always blocked")
+	flag.IntVar(&denylistPoll, "denylist-poll", 60,
+		"interval (seconds) to reload the denylist from the store, for changes by other replicas, 0 to disable")
+	flag.IntVar(&maxMindPoll, "mmdb-poll", 0,
+		"interval (seconds) to poll the MaxMind DB file for changes, 0 to disable")
+	flag.StringVar(&locale, "locale", service.DefaultLocale,
+		"locale for country, subdivision and city names, e.g. 'en', 'de', 'pt-BR'")
 	flag.StringVar(&dbFilePath, "db", "./db/requests.db",
 		"location of SQLite DB file")
+	flag.StringVar(&storeDriver, "store", "sqlite",
+		"store implementation: 'sqlite', 'postgres', 'memory'")
+	flag.StringVar(&dsn, "dsn", os.Getenv("IPVERIFY_DSN"),
+		"PostgreSQL connection string for the postgres store (default $IPVERIFY_DSN)")
+	flag.StringVar(&snapshotPath, "snapshot", "",
+		"location of optional file the memory store is saved to on shutdown and loaded from at startup")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("IPVERIFY_ADMIN_TOKEN"),
+		"bearer token required for destructive admin endpoints (default $IPVERIFY_ADMIN_TOKEN)")
+	flag.StringVar(&apiKeysPath, "api-keys", "",
+		"location of optional file of hashed API keys, required on all but the status endpoint if set")
+	flag.StringVar(&hmacPath, "hmac-secrets", "",
+		"location of optional file of HMAC secrets for signing verify requests")
+	flag.IntVar(&hmacSkew, "hmac-skew", 300,
+		"allowed clock skew (seconds) for signed requests")
+	flag.BoolVar(&disableReset, "disable-reset", false,
+		"remove the database reset endpoint, e.g. in production")
+	flag.IntVar(&retentionDays, "retention-days", 0,
+		"days to keep events, 0 to keep them forever")
+	flag.IntVar(&maxUserEvents, "max-events-per-user", 0,
+		"maximum number of events kept per user, 0 for no limit")
+	flag.IntVar(&pruneInterval, "prune-interval", 3600,
+		"interval (seconds) to delete events outside the retention policy")
+	flag.Float64Var(&maxSpeed, "max-speed", types.MaxSpeed,
+		"speed above which travel is considered suspicious")
+	flag.StringVar(&speedUnit, "speed-unit", string(types.DefaultSpeedUnit),
+		"unit of the speed thresholds: 'mph', 'kph'")
+	flag.StringVar(&groupMaxSpeed, "group-max-speed", "",
+		"per user group speed thresholds, e.g. 'travel=800,fraud=300'")
+	flag.Float64Var(&sameASNFactor, "same-asn-factor", 1,
+		"speed threshold multiplier for consecutive logins from the same ASN")
+	flag.StringVar(&canaryIP, "canary-ip", service.DefaultCanaryIP,
+		"address the readiness check looks up in the MaxMind DB")
 }
 
 func main() {
@@ -57,27 +149,139 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The migrate command works on the database without starting the
+	// server.
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:], log); err != nil {
+			fmt.Fprintf(os.Stderr, "Error migrating database: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create the server to handle the IP verify service.  The API module will
 	// set up the routes, as we don't need to know the details in the
 	// main program.
 	muxer := mux.NewRouter()
 
 	// Initialize the store.
-	store, err := store.NewSQLiteStore(dbFilePath, log)
+	store, err := newStore(log)
 	if err != nil {
 		log.Errorw("Error initializing service", "error", err)
 		os.Exit(1)
 	}
 
-	// Build the service, passing it the maxmind path and the store.
-	service, err := service.New(maxMindFilepath, store, log)
+	// Build the service options from the verdict tuning flags.
+	opts, err := serviceOptions()
+	if err != nil {
+		log.Errorw("Error initializing service", "error", err)
+		os.Exit(1)
+	}
+
+	// Open the Maxmind DB used for geolocation.
+	geoOpts := []service.MaxMindOption{service.WithLocale(locale)}
+	if asnFilepath != "" {
+		geoOpts = append(geoOpts, service.WithASNDatabase(asnFilepath))
+	}
+	geo, err := service.NewMaxMindGeolocator(maxMindFilepath, log, geoOpts...)
+	if err != nil {
+		log.Errorw("Error initializing service", "error", err)
+		os.Exit(1)
+	}
+
+	// The watchers have their own context, and are stopped and waited for
+	// on shutdown before the geolocator and the store are closed.
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	var watchers sync.WaitGroup
+	watch := func(f func(context.Context)) {
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			f(watchCtx)
+		}()
+	}
+	stopWatchers := func() {
+		cancelWatch()
+		watchers.Wait()
+	}
+
+	if maxMindPoll > 0 {
+		watch(func(ctx context.Context) {
+			geo.Watch(ctx, time.Duration(maxMindPoll)*time.Second)
+		})
+	}
+
+	// Start deleting old events, if there is a retention policy.  The
+	// pruner is stopped before the store is shut down.
+	stopPruner := func() {}
+	if retentionDays < 0 || maxUserEvents < 0 {
+		log.Errorw("Error initializing service", "error",
+			fmt.Errorf("invalid retention: %d days, %d events per user", retentionDays, maxUserEvents))
+		os.Exit(1)
+	}
+	if retentionDays > 0 || maxUserEvents > 0 {
+		if pruneInterval <= 0 {
+			log.Errorw("Error initializing service", "error",
+				fmt.Errorf("invalid prune interval: %d", pruneInterval))
+			os.Exit(1)
+		}
+		pruner := service.NewPruner(store, log,
+			service.WithMaxAge(time.Duration(retentionDays)*24*time.Hour),
+			service.WithMaxEventsPerUser(maxUserEvents))
+		pruner.Start(time.Duration(pruneInterval) * time.Second)
+		stopPruner = pruner.Stop
+		opts = append(opts, service.WithPruner(pruner))
+	}
+
+	// Build the service, passing it the geolocator and the store.
+	service, err := service.New(geo, store, log, opts...)
 	if err != nil {
 		log.Errorw("Error initializing service", "error", err)
 		os.Exit(1)
 	}
 
+	if denylistPoll > 0 {
+		watch(func(ctx context.Context) {
+			service.WatchDenylist(ctx, time.Duration(denylistPoll)*time.Second)
+		})
+	}
+
 	// Initialize the API layer.
-	if err := api.Init(ctx, muxer, service, log); err != nil {
+	apiOpts := []api.Option{api.WithAdminToken(adminToken)}
+	if disableReset {
+		apiOpts = append(apiOpts, api.WithResetDisabled())
+	}
+	if apiKeysPath != "" {
+		keys, err := auth.LoadFile(apiKeysPath)
+		if err != nil {
+			log.Errorw("Error initializing API layer", "error", err)
+			os.Exit(1)
+		}
+		log.Infow("Loaded API keys", "count", keys.Len())
+		apiOpts = append(apiOpts, api.WithAPIKeys(keys))
+	}
+	if hmacPath != "" {
+		if hmacSkew <= 0 {
+			log.Errorw("Error initializing API layer", "error",
+				fmt.Errorf("invalid HMAC clock skew: %d", hmacSkew))
+			os.Exit(1)
+		}
+		secrets, err := auth.LoadSecretsFile(hmacPath)
+		if err != nil {
+			log.Errorw("Error initializing API layer", "error", err)
+			os.Exit(1)
+		}
+		log.Infow("Loaded HMAC secrets", "clients", len(secrets))
+		apiOpts = append(apiOpts, api.WithHMAC(auth.NewHMACVerifier(secrets,
+			time.Duration(hmacSkew)*time.Second)))
+	}
+	if apiKeysPath == "" && hmacPath == "" {
+		log.Warnw("No API keys or HMAC secrets configured, endpoints are unauthenticated")
+	}
+	if requestTimeout > 0 {
+		apiOpts = append(apiOpts, api.WithRequestTimeout(time.Duration(requestTimeout)*time.Second))
+	}
+	if err := api.Init(muxer, service, log, apiOpts...); err != nil {
 		log.Errorf("Error initializing API layer", "error", err)
 		os.Exit(1)
 	}
@@ -87,6 +291,9 @@ func main() {
 		Addr:         fmt.Sprintf(":%d", portNum),
 		ReadTimeout:  time.Duration(timeout) * time.Second,
 		WriteTimeout: time.Duration(timeout) * time.Second,
+
+		// Requests are cancelled along with the program's context.
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
 	// Start server
@@ -98,7 +305,152 @@ func main() {
 	}()
 
 	// Block until we shutdown.
-	waitForShutdown(ctx, srv, log, service.Shutdown)
+	waitForShutdown(cancel, srv, log, service.ReloadGeoDB, stopWatchers, stopPruner,
+		service.Shutdown)
+}
+
+// Convert the speed threshold and other verdict tuning flags to service
+// options.
+func serviceOptions() ([]service.Option, error) {
+	unit, err := types.ParseSpeedUnit(speedUnit)
+	if err != nil {
+		return nil, err
+	}
+	if maxSpeed <= 0 {
+		return nil, fmt.Errorf("invalid max speed: %g", maxSpeed)
+	}
+	if sameASNFactor <= 0 {
+		return nil, fmt.Errorf("invalid same ASN factor: %g", sameASNFactor)
+	}
+	opts := []service.Option{
+		service.WithMaxSpeed(maxSpeed, unit),
+		service.WithSameASNFactor(sameASNFactor),
+		service.WithCanaryIP(canaryIP),
+	}
+	ac, err := anonymityChecker()
+	if err != nil {
+		return nil, err
+	}
+	if ac != nil {
+		opts = append(opts, service.WithAnonymityChecker(ac))
+	}
+	if trustedPath != "" {
+		mode, err := service.ParseTrustMode(trustMode)
+		if err != nil {
+			return nil, err
+		}
+		set, err := iplist.LoadFile(trustedPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, service.WithTrustedNetworks(set, mode))
+	}
+	if denylistPath != "" {
+		set, err := iplist.LoadFile(denylistPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, service.WithDenylist(set))
+	}
+	if groupMaxSpeed == "" {
+		return opts, nil
+	}
+	for _, gs := range strings.Split(groupMaxSpeed, ",") {
+		parts := strings.SplitN(gs, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid group max speed: %s", gs)
+		}
+		speed, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || speed <= 0 {
+			return nil, fmt.Errorf("invalid group max speed: %s", gs)
+		}
+		opts = append(opts, service.WithGroupMaxSpeed(parts[0], speed, unit))
+	}
+	return opts, nil
+}
+
+// Build the anonymity checker from whichever of the Anonymous-IP DB and
+// address lists are configured.  If none are, no checker is returned.
+func anonymityChecker() (*service.AnonymityChecker, error) {
+	var opts []service.AnonymityOption
+	if anonFilepath != "" {
+		opts = append(opts, service.WithAnonymousIPDatabase(anonFilepath))
+	}
+	for _, l := range []struct {
+		path string
+		opt  func(*iplist.Set) service.AnonymityOption
+	}{
+		{proxyListPath, service.WithProxyList},
+		{hostingListPath, service.WithHostingList},
+		{torListPath, service.WithTorExitList},
+	} {
+		if l.path == "" {
+			continue
+		}
+		set, err := iplist.LoadFile(l.path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, l.opt(set))
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	return service.NewAnonymityChecker(opts...)
+}
+
+// Create the store selected by the flags.
+func newStore(log *zap.SugaredLogger) (store.Store, error) {
+	switch storeDriver {
+	case "sqlite":
+		return store.NewSQLiteStore(dbFilePath, log)
+	case "postgres":
+		if dsn == "" {
+			return nil, errors.New("the postgres store requires a connection string")
+		}
+		return store.NewPostgresStore(dsn, log)
+	case "memory":
+		return store.NewMemoryStore(snapshotPath, log)
+	default:
+		return nil, fmt.Errorf("unknown store: %q", storeDriver)
+	}
+}
+
+// Run the migrate command: with no arguments, apply any pending migrations
+// to the SQLite database, or with "status", list the migrations and when
+// each was applied.
+func runMigrate(args []string, log *zap.SugaredLogger) error {
+	if storeDriver != "sqlite" {
+		return fmt.Errorf("migrations apply only to the sqlite store, not %q", storeDriver)
+	}
+	var migrations []store.Migration
+	var err error
+	switch {
+	case len(args) == 0:
+		migrations, err = store.MigrateSQLite(dbFilePath, log)
+		if err == nil && len(migrations) == 0 {
+			fmt.Println("Database schema is up to date")
+			return nil
+		}
+	case len(args) == 1 && args[0] == "status":
+		migrations, err = store.SQLiteMigrations(dbFilePath)
+	default:
+		return fmt.Errorf("usage: %s [flags] migrate [status]", os.Args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, m := range migrations {
+		applied := "pending"
+		if m.Applied != 0 {
+			applied = time.Unix(m.Applied, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, applied, m.Description)
+	}
+	return w.Flush()
 }
 
 // Set up the logger, condsidering any env vars.
@@ -125,23 +477,36 @@ func initLogging() (*zap.SugaredLogger, error) {
 	return lg.Sugar(), nil
 }
 
-// Setup for clean shutdown with signal handlers/cancel.
-func waitForShutdown(ctx context.Context, srv *http.Server,
-	log *zap.SugaredLogger, tasks ...cleanupTask) {
+// Setup for clean shutdown with signal handlers/cancel.  A SIGHUP reloads
+// the MaxMind DB rather than shutting down.
+func waitForShutdown(cancel context.CancelFunc, srv *http.Server,
+	log *zap.SugaredLogger, reload func() error, tasks ...cleanupTask) {
 	interruptChan := make(chan os.Signal, 1)
-	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGHUP)
 
-	// Block until we receive our signal.
-	sig := <-interruptChan
-	log.Debugw("Termination signal received", "signal", sig)
+	// Block until we receive our termination signal.
+	for sig := range interruptChan {
+		if sig != syscall.SIGHUP {
+			log.Debugw("Termination signal received", "signal", sig)
+			break
+		}
+		log.Infow("Reload signal received", "signal", sig)
+		if err := reload(); err != nil {
+			log.Errorw("Error reloading MaxMind DB", "error", err)
+		}
+	}
+	// Give the requests in progress a deadline to finish, and then cancel
+	// any that haven't, before the cleanup tasks close the store.
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancelShutdown()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warnw("Server shutdown", "error", err)
+	}
+	cancel()
 	for _, t := range tasks {
 		t()
 	}
 
-	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
-	defer cancel()
-	srv.Shutdown(ctx)
-
 	log.Infof("Shutting down")
 }
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gdotgordon/ipverify/iplist"
+	"github.com/gdotgordon/ipverify/types"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// AnonymityChecker flags IP addresses belonging to anonymizers, such as
+// VPNs and public proxies, hosting providers and Tor exit nodes.  It uses
+// a GeoIP2 Anonymous-IP style database and/or lists of addresses and CIDR
+// blocks, all loaded from local files.
+type AnonymityChecker struct {
+	reader  *maxminddb.Reader
+	proxy   *iplist.Set
+	hosting *iplist.Set
+	tor     *iplist.Set
+}
+
+// AnonymityOption is used to configure the sources of the AnonymityChecker.
+type AnonymityOption func(*AnonymityChecker) error
+
+// WithAnonymousIPDatabase adds a GeoIP2 Anonymous-IP style database.
+func WithAnonymousIPDatabase(path string) AnonymityOption {
+	return func(ac *AnonymityChecker) error {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			return Error(err.Error())
+		}
+		ac.reader = reader
+		return nil
+	}
+}
+
+// WithProxyList adds a list of anonymous proxy and VPN addresses.
+func WithProxyList(set *iplist.Set) AnonymityOption {
+	return func(ac *AnonymityChecker) error {
+		ac.proxy = set
+		return nil
+	}
+}
+
+// WithHostingList adds a list of hosting provider addresses, such as
+// cloud provider ranges.
+func WithHostingList(set *iplist.Set) AnonymityOption {
+	return func(ac *AnonymityChecker) error {
+		ac.hosting = set
+		return nil
+	}
+}
+
+// WithTorExitList adds a list of Tor exit node addresses.
+func WithTorExitList(set *iplist.Set) AnonymityOption {
+	return func(ac *AnonymityChecker) error {
+		ac.tor = set
+		return nil
+	}
+}
+
+// NewAnonymityChecker creates an AnonymityChecker from the sources.
+func NewAnonymityChecker(opts ...AnonymityOption) (*AnonymityChecker, error) {
+	ac := &AnonymityChecker{}
+	for _, o := range opts {
+		if err := o(ac); err != nil {
+			ac.Close()
+			return nil, err
+		}
+	}
+	return ac, nil
+}
+
+// Anonymity is the result of an anonymity check.  The reasons explain
+// each of the flags that is set.
+type Anonymity struct {
+	AnonymousProxy bool
+	Hosting        bool
+	TorExit        bool
+	Reasons        []types.Reason
+}
+
+// Check looks up the IP address in the database and lists.
+func (ac *AnonymityChecker) Check(ip string) (Anonymity, error) {
+	var res Anonymity
+	ipn := net.ParseIP(ip)
+	if ipn == nil {
+		return res, fmt.Errorf("invalid IP addr format: %s", ip)
+	}
+
+	if ac.reader != nil {
+		var rec struct {
+			AnonymousVPN     bool `maxminddb:"is_anonymous_vpn"`
+			HostingProvider  bool `maxminddb:"is_hosting_provider"`
+			PublicProxy      bool `maxminddb:"is_public_proxy"`
+			ResidentialProxy bool `maxminddb:"is_residential_proxy"`
+			TorExitNode      bool `maxminddb:"is_tor_exit_node"`
+		}
+		if err := ac.reader.Lookup(ipn, &rec); err != nil {
+			return res, err
+		}
+		dbType := ac.reader.Metadata.DatabaseType
+		if rec.AnonymousVPN || rec.PublicProxy || rec.ResidentialProxy {
+			res.flag(types.ReasonAnonymousProxy, dbType)
+		}
+		if rec.HostingProvider {
+			res.flag(types.ReasonHosting, dbType)
+		}
+		if rec.TorExitNode {
+			res.flag(types.ReasonTorExit, dbType)
+		}
+	}
+
+	for _, l := range []struct {
+		set  *iplist.Set
+		code types.ReasonCode
+	}{
+		{ac.proxy, types.ReasonAnonymousProxy},
+		{ac.hosting, types.ReasonHosting},
+		{ac.tor, types.ReasonTorExit},
+	} {
+		if l.set == nil {
+			continue
+		}
+		if entry, ok := l.set.Contains(ipn); ok {
+			res.flag(l.code, entry)
+		}
+	}
+	return res, nil
+}
+
+// Close closes the Anonymous-IP database, if any.
+func (ac *AnonymityChecker) Close() error {
+	if ac.reader == nil {
+		return nil
+	}
+	return ac.reader.Close()
+}
+
+// flag sets the flag for the reason code and records the reason, unless
+// the flag was already set by another source.
+func (a *Anonymity) flag(code types.ReasonCode, detail string) {
+	var f *bool
+	switch code {
+	case types.ReasonAnonymousProxy:
+		f = &a.AnonymousProxy
+	case types.ReasonHosting:
+		f = &a.Hosting
+	case types.ReasonTorExit:
+		f = &a.TorExit
+	}
+	if *f {
+		return
+	}
+	*f = true
+	a.Reasons = append(a.Reasons, types.Reason{Code: code, Detail: detail})
+}
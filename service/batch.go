@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gdotgordon/ipverify/types"
+	"github.com/pkg/errors"
+)
+
+// BatchResult is the outcome of one request in a batch verify.  Exactly
+// one of the response and the error is set.
+type BatchResult struct {
+	Response *types.VerifyResponse
+	Err      error
+}
+
+// VerifyBatch verifies a batch of requests, returning the results in the
+// same order as the requests.  All the non-dry-run requests are added to
+// the store before any are evaluated, so events within the batch see each
+// other as neighbors, and they are then evaluated in timestamp order per
+// user.  A request that fails, for example due to a duplicate UUID, does
+// not affect the others, and one that fails after being added is removed
+// again.  Dry run requests are evaluated against the batch, but are not
+// recorded.
+func (vs *VerifyService) VerifyBatch(ctx context.Context, reqs []types.VerifyRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+	reqs = append([]types.VerifyRequest(nil), reqs...)
+	var pending []int
+	for i := range reqs {
+		req := &reqs[i]
+		if !req.DryRun {
+			if err := vs.locate(req); err != nil {
+				results[i].Err = err
+				continue
+			}
+			if err := vs.store.AddRecord(ctx, *req); err != nil {
+				results[i].Err = errors.Wrap(contextError(ctx, err), "add record to store")
+				continue
+			}
+		}
+		pending = append(pending, i)
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		ri, rj := reqs[pending[i]], reqs[pending[j]]
+		if ri.Username != rj.Username {
+			return ri.Username < rj.Username
+		}
+		return ri.UnixTimestamp < rj.UnixTimestamp
+	})
+	for _, i := range pending {
+		results[i].Response, results[i].Err = vs.evaluate(ctx, reqs[i])
+		if reqs[i].DryRun {
+			continue
+		}
+		if results[i].Err != nil {
+			vs.removeRecord(reqs[i].EventUUID)
+			continue
+		}
+		vs.recordVerdict(ctx, reqs[i].EventUUID, results[i].Response)
+	}
+	return results
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -15,21 +16,44 @@ import (
 // various optimizations on the main verify() API, such as building
 // an index on the timestamp in the database, caching IP lookups, etc.
 // It repeatedly invokes the verify endpoint with randomly generated
-// user names.
+// user names, against each of the SQLite and in-memory stores.
 
 func BenchmarkIndex(b *testing.B) {
-	tmpfile, err := ioutil.TempFile("", "index_bench")
-	if err != nil {
-		b.Fatalf("error creating temp file: %v", err)
+	if _, err := os.Stat(mmdbPath); os.IsNotExist(err) {
+		b.Skipf("%s not present", mmdbPath)
 	}
-	defer os.Remove(tmpfile.Name())
-
 	log := newNoopLogger()
-	store, err := store.NewSQLiteStore(tmpfile.Name(), log)
+	geo, err := NewMaxMindGeolocator(mmdbPath, log)
 	if err != nil {
-		b.Fatalf("error creating db: %v", err)
+		b.Fatalf("error opening maxmind db: %v", err)
 	}
-	srv, err := New("../mmdb/GeoLite2-City.mmdb", store, log)
+
+	b.Run("sqlite", func(b *testing.B) {
+		tmpfile, err := ioutil.TempFile("", "index_bench")
+		if err != nil {
+			b.Fatalf("error creating temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		store, err := store.NewSQLiteStore(tmpfile.Name(), log)
+		if err != nil {
+			b.Fatalf("error creating db: %v", err)
+		}
+		defer store.Shutdown()
+		benchmarkVerify(b, geo, store)
+	})
+	b.Run("memory", func(b *testing.B) {
+		store, err := store.NewMemoryStore("", log)
+		if err != nil {
+			b.Fatalf("error creating store: %v", err)
+		}
+		benchmarkVerify(b, geo, store)
+	})
+}
+
+func benchmarkVerify(b *testing.B, geo Geolocator, store store.Store) {
+	ctx := context.Background()
+	srv, err := New(geo, store, newNoopLogger())
 	if err != nil {
 		b.Fatalf("error creating service: %v", err)
 	}
@@ -42,12 +66,13 @@ func BenchmarkIndex(b *testing.B) {
 	now := time.Now()
 	rand.Seed(now.Unix())
 
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		// Randomize the timestamps over the last 5 hours
 		req := makeReq(users[rand.Int()%20], "128.148.252.151", (now.Unix() - int64(rand.Int()%(3600*5))))
 
 		// Invoke the verify service
-		_, err := srv.VerifyIP(req)
+		_, err := srv.VerifyIP(ctx, req)
 		if err != nil {
 			b.Fatalf("error verifying request: %v", err)
 		}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gdotgordon/ipverify/iplist"
+	"github.com/gdotgordon/ipverify/types"
+	"github.com/pkg/errors"
+)
+
+// NotFoundError is used to tag errors for items that do not exist, to
+// distinguish them from other user errors.
+type NotFoundError string
+
+func (e NotFoundError) Error() string {
+	return string(e)
+}
+
+// WithDenylist sets the denylist entries loaded from a file.  These are in
+// addition to the entries managed through the API and persisted in the
+// store, and may not be removed through the API.
+func WithDenylist(set *iplist.Set) Option {
+	return func(vs *VerifyService) {
+		vs.denyFile = set
+	}
+}
+
+// loadDenylist replaces the denylist entries managed through the API with
+// those in the store.
+func (vs *VerifyService) loadDenylist(ctx context.Context) error {
+	entries, err := vs.store.GetDenylist(ctx)
+	if err != nil {
+		return storeError(ctx, err)
+	}
+	set := iplist.New()
+	for _, e := range entries {
+		if err := set.Add(e.Entry); err != nil {
+			vs.log.Warnw("invalid denylist entry in store", "entry", e.Entry, "error", err)
+		}
+	}
+	vs.denyMu.Lock()
+	vs.denyAPI = set
+	vs.denyMu.Unlock()
+	return nil
+}
+
+// WatchDenylist reloads the denylist entries managed through the API from
+// the store at the specified interval, until the context is done.  This
+// picks up changes made by other replicas sharing the store, which are not
+// otherwise seen until the service is restarted.
+func (vs *VerifyService) WatchDenylist(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := vs.loadDenylist(ctx); err != nil && ctx.Err() == nil {
+				vs.log.Warnw("denylist reload", "error", err)
+			}
+		}
+	}
+}
+
+// apiDenylist returns the current set of entries managed through the API.
+func (vs *VerifyService) apiDenylist() *iplist.Set {
+	vs.denyMu.RLock()
+	defer vs.denyMu.RUnlock()
+	return vs.denyAPI
+}
+
+// denylisted returns the denylist entry containing the IP address, if any.
+func (vs *VerifyService) denylisted(ip string) (string, bool) {
+	if vs.denyFile != nil {
+		if entry, ok := vs.denyFile.ContainsString(ip); ok {
+			return entry, true
+		}
+	}
+	return vs.apiDenylist().ContainsString(ip)
+}
+
+// GetDenylist returns the denylist entries from the file, followed by the
+// ones added through the API.
+func (vs *VerifyService) GetDenylist(ctx context.Context) ([]types.DenylistEntry, error) {
+	var result []types.DenylistEntry
+	if vs.denyFile != nil {
+		for _, e := range vs.denyFile.Entries() {
+			result = append(result, types.DenylistEntry{Entry: e, Source: types.DenylistFile})
+		}
+	}
+	entries, err := vs.store.GetDenylist(ctx)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	for _, e := range entries {
+		e.Source = types.DenylistAPI
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// AddDenylistEntry validates, persists and activates a new denylist entry.
+// The entry is returned in its canonical form.
+func (vs *VerifyService) AddDenylistEntry(ctx context.Context,
+	entry types.DenylistEntry) (types.DenylistEntry, error) {
+	_, canon, err := iplist.Parse(entry.Entry)
+	if err != nil {
+		return entry, err
+	}
+	entry.Entry = canon
+	entry.Source = types.DenylistAPI
+	entry.Created = time.Now().Unix()
+	if err := vs.store.AddDenylistEntry(ctx, entry); err != nil {
+		return entry, errors.Wrap(contextError(ctx, err), "add denylist entry to store")
+	}
+	if err := vs.apiDenylist().Add(entry.Entry); err != nil {
+		return entry, Error(err.Error())
+	}
+	vs.log.Infow("Added denylist entry", "entry", entry.Entry)
+	return entry, nil
+}
+
+// RemoveDenylistEntry deletes a denylist entry that was added through the API.
+func (vs *VerifyService) RemoveDenylistEntry(ctx context.Context, entry string) error {
+	_, canon, err := iplist.Parse(entry)
+	if err != nil {
+		return err
+	}
+	ok, err := vs.store.RemoveDenylistEntry(ctx, canon)
+	if err != nil {
+		return storeError(ctx, err)
+	}
+	if !ok {
+		if vs.denyFile != nil && vs.denyFile.Has(canon) {
+			return fmt.Errorf("denylist entry %s is from the denylist file", canon)
+		}
+		return NotFoundError(fmt.Sprintf("denylist entry %s not found", canon))
+	}
+	if _, err := vs.apiDenylist().Remove(canon); err != nil {
+		return Error(err.Error())
+	}
+	vs.log.Infow("Removed denylist entry", "entry", canon)
+	return nil
+}
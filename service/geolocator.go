@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/ipverify/types"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// Location is the struct returned by geolocation lookups.  The struct tags
+// map it to the "location" section of a Maxmind DB record, the place names
+// come from other sections of the record.
+type Location struct {
+	AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
+	Latitude       float64 `maxminddb:"latitude"`
+	Longitude      float64 `maxminddb:"longitude"`
+	MetroCode      uint    `maxminddb:"metro_code"`
+	TimeZone       string  `maxminddb:"time_zone"`
+	CountryCode    string  `maxminddb:"-"`
+	Subdivision    string  `maxminddb:"-"`
+	City           string  `maxminddb:"-"`
+	ASN            uint    `maxminddb:"-"`
+	ASOrg          string  `maxminddb:"-"`
+}
+
+// Geolocator looks up the location of an IP address.  Implementations must
+// be safe for concurrent use.  As with the Maxmind DB, an address that is
+// not found yields the zero Location rather than an error.
+type Geolocator interface {
+	Lookup(ip string) (Location, error)
+	Info() types.GeoDBInfo
+	Close() error
+}
+
+// Reloader is implemented by Geolocators whose underlying database may be
+// reloaded without restarting the service.
+type Reloader interface {
+	Reload() error
+}
+
+// MaxMindGeolocator is the Geolocator backed by a Maxmind City database, and
+// optionally an ASN (or ISP) database for network ownership.  The databases
+// may be reloaded while lookups are in progress.  The read lock is held for
+// the duration of each lookup, so a reload waits for in-flight lookups to
+// drain before closing the old readers.
+type MaxMindGeolocator struct {
+	sync.RWMutex
+	path       string
+	locale     string
+	reader     *maxminddb.Reader
+	modTime    time.Time
+	asnPath    string
+	asnReader  *maxminddb.Reader
+	asnModTime time.Time
+	log        *zap.SugaredLogger
+}
+
+// MaxMindOption is used to configure optional settings of the
+// MaxMindGeolocator.
+type MaxMindOption func(*MaxMindGeolocator)
+
+// WithLocale sets the locale, such as "en" or "pt-BR", for place names.
+func WithLocale(locale string) MaxMindOption {
+	return func(mg *MaxMindGeolocator) {
+		mg.locale = locale
+	}
+}
+
+// WithASNDatabase adds a GeoLite2-ASN or GeoIP2-ISP database, used to look up
+// the autonomous system of an IP address.
+func WithASNDatabase(path string) MaxMindOption {
+	return func(mg *MaxMindGeolocator) {
+		mg.asnPath = path
+	}
+}
+
+// NewMaxMindGeolocator opens the Maxmind DB file at the specified location.
+func NewMaxMindGeolocator(mmDBPath string, log *zap.SugaredLogger,
+	opts ...MaxMindOption) (*MaxMindGeolocator, error) {
+	mg := &MaxMindGeolocator{path: mmDBPath, locale: DefaultLocale, log: log}
+	for _, o := range opts {
+		o(mg)
+	}
+	if err := mg.Reload(); err != nil {
+		return nil, err
+	}
+	return mg, nil
+}
+
+// Lookup gets the location of the IP address from the Maxmind DB, recording
+// the latency and any failure in the metrics.
+func (mg *MaxMindGeolocator) Lookup(ip string) (Location, error) {
+	start := time.Now()
+	loc, err := mg.lookup(ip)
+	geoLookupDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		geoLookupFailures.Inc()
+	}
+	return loc, err
+}
+
+// lookup does the actual lookup, holding the read lock.
+func (mg *MaxMindGeolocator) lookup(ip string) (Location, error) {
+	mg.RLock()
+	defer mg.RUnlock()
+	loc, err := lookupIP(ip, mg.reader, mg.locale, mg.log)
+	if err != nil || mg.asnReader == nil {
+		return loc, err
+	}
+	loc.ASN, loc.ASOrg, err = lookupASN(ip, mg.asnReader)
+	return loc, err
+}
+
+// Info returns the type and build time of the loaded Maxmind DB.
+func (mg *MaxMindGeolocator) Info() types.GeoDBInfo {
+	mg.RLock()
+	defer mg.RUnlock()
+	info := types.GeoDBInfo{
+		Type:       mg.reader.Metadata.DatabaseType,
+		BuildEpoch: mg.reader.Metadata.BuildEpoch,
+	}
+	if mg.asnReader != nil {
+		info.ASNType = mg.asnReader.Metadata.DatabaseType
+		info.ASNBuildEpoch = mg.asnReader.Metadata.BuildEpoch
+	}
+	return info
+}
+
+// Reload opens the Maxmind DB files again and swaps them in for the current
+// ones, which are closed once any in-flight lookups have completed.
+func (mg *MaxMindGeolocator) Reload() error {
+	reader, modTime, err := openMaxMind(mg.path)
+	if err != nil {
+		return err
+	}
+	var asnReader *maxminddb.Reader
+	var asnModTime time.Time
+	if mg.asnPath != "" {
+		if asnReader, asnModTime, err = openMaxMind(mg.asnPath); err != nil {
+			reader.Close()
+			return err
+		}
+	}
+
+	mg.Lock()
+	old, oldASN := mg.reader, mg.asnReader
+	mg.reader, mg.modTime = reader, modTime
+	mg.asnReader, mg.asnModTime = asnReader, asnModTime
+	mg.Unlock()
+
+	for _, r := range []*maxminddb.Reader{old, oldASN} {
+		if r == nil {
+			continue
+		}
+		if err := r.Close(); err != nil {
+			mg.log.Warnw("Maxmind close after reload", "error", err)
+		}
+	}
+	mg.log.Infow("Loaded Maxmind DB", "path", mg.path,
+		"type", reader.Metadata.DatabaseType, "buildEpoch", reader.Metadata.BuildEpoch)
+	if asnReader != nil {
+		mg.log.Infow("Loaded Maxmind DB", "path", mg.asnPath,
+			"type", asnReader.Metadata.DatabaseType, "buildEpoch", asnReader.Metadata.BuildEpoch)
+	}
+	return nil
+}
+
+// Watch polls the Maxmind DB file at the specified interval, and reloads it
+// when its modification time changes.  It returns when the context is done.
+func (mg *MaxMindGeolocator) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := mg.changed()
+			if err != nil {
+				mg.log.Warnw("Maxmind DB stat", "error", err)
+				continue
+			}
+			if changed {
+				if err := mg.Reload(); err != nil {
+					mg.log.Errorw("Maxmind DB reload", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// changed reports whether either of the Maxmind DB files has been modified
+// since it was loaded.
+func (mg *MaxMindGeolocator) changed() (bool, error) {
+	fi, err := os.Stat(mg.path)
+	if err != nil {
+		return false, err
+	}
+	mg.RLock()
+	defer mg.RUnlock()
+	if !fi.ModTime().Equal(mg.modTime) {
+		return true, nil
+	}
+	if mg.asnPath == "" {
+		return false, nil
+	}
+	if fi, err = os.Stat(mg.asnPath); err != nil {
+		return false, err
+	}
+	return !fi.ModTime().Equal(mg.asnModTime), nil
+}
+
+// Close closes the Maxmind DBs.
+func (mg *MaxMindGeolocator) Close() error {
+	mg.Lock()
+	defer mg.Unlock()
+	if mg.asnReader != nil {
+		if err := mg.asnReader.Close(); err != nil {
+			mg.log.Warnw("Maxmind ASN DB close", "error", err)
+		}
+	}
+	return mg.reader.Close()
+}
+
+// openMaxMind opens a Maxmind DB file, returning it along with the file's
+// modification time.
+func openMaxMind(path string) (*maxminddb.Reader, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, Error(err.Error())
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, time.Time{}, Error(err.Error())
+	}
+	return reader, fi.ModTime(), nil
+}
+
+// StaticGeolocator is an in-memory Geolocator with a fixed set of locations,
+// useful for tests and for running without a Maxmind DB.
+type StaticGeolocator struct {
+	locs map[string]Location
+}
+
+// NewStaticGeolocator creates a StaticGeolocator from a map of IP address
+// to location.
+func NewStaticGeolocator(locs map[string]Location) *StaticGeolocator {
+	sg := &StaticGeolocator{locs: make(map[string]Location, len(locs))}
+	for ip, loc := range locs {
+		if ipn := net.ParseIP(ip); ipn != nil {
+			ip = ipn.String()
+		}
+		sg.locs[ip] = loc
+	}
+	return sg
+}
+
+// Lookup gets the location of the IP address from the map.
+func (sg *StaticGeolocator) Lookup(ip string) (Location, error) {
+	ipn := net.ParseIP(ip)
+	if ipn == nil {
+		return Location{}, fmt.Errorf("invalid IP addr format: %s", ip)
+	}
+	return sg.locs[ipn.String()], nil
+}
+
+// Info describes the StaticGeolocator.
+func (sg *StaticGeolocator) Info() types.GeoDBInfo {
+	return types.GeoDBInfo{Type: "static"}
+}
+
+// Close is a no-op for the StaticGeolocator.
+func (sg *StaticGeolocator) Close() error {
+	return nil
+}
+
+// DefaultLocale is the locale used for place names when none is configured,
+// and as the fallback when a name is not available in the configured locale.
+const DefaultLocale = "en"
+
+// placeNames is the part of a Maxmind City record holding localized names.
+type placeNames struct {
+	ISOCode string            `maxminddb:"iso_code"`
+	Names   map[string]string `maxminddb:"names"`
+}
+
+// name returns the name in the locale, falling back to the default locale
+// and then the ISO code.
+func (pn placeNames) name(locale string) string {
+	if n, ok := pn.Names[locale]; ok {
+		return n
+	}
+	if n, ok := pn.Names[DefaultLocale]; ok {
+		return n
+	}
+	return pn.ISOCode
+}
+
+// lookupIP does a MaxMind lookup, using the more efficient lower-level API.
+// Place names are returned in the specified locale where available.
+func lookupIP(ip string, db *maxminddb.Reader, locale string,
+	log *zap.SugaredLogger) (Location, error) {
+	// Syntactic weirdness due to using recommended low-level API, which
+	// requires a struct tag.
+	var rec struct {
+		Loc          Location     `maxminddb:"location"`
+		Country      placeNames   `maxminddb:"country"`
+		Subdivisions []placeNames `maxminddb:"subdivisions"`
+		City         placeNames   `maxminddb:"city"`
+	}
+
+	ipn := net.ParseIP(ip)
+	if ipn == nil {
+		log.Errorw("bad IP address not caught by validation", "IPaddr", ip)
+		return rec.Loc, fmt.Errorf("invalid IP addr format: %s", ip)
+	}
+	err := db.Lookup(ipn, &rec)
+	if err != nil {
+		return rec.Loc, err
+	}
+
+	// The subdivisions are ordered from most general to most specific, so
+	// the first is the state or province.
+	loc := rec.Loc
+	loc.CountryCode = rec.Country.ISOCode
+	if len(rec.Subdivisions) > 0 {
+		loc.Subdivision = rec.Subdivisions[0].name(locale)
+	}
+	loc.City = rec.City.name(locale)
+	return loc, nil
+}
+
+// lookupASN does a lookup in a Maxmind ASN or ISP database, which share the
+// autonomous system fields.
+func lookupASN(ip string, db *maxminddb.Reader) (uint, string, error) {
+	var rec struct {
+		ASN   uint   `maxminddb:"autonomous_system_number"`
+		ASOrg string `maxminddb:"autonomous_system_organization"`
+	}
+
+	ipn := net.ParseIP(ip)
+	if ipn == nil {
+		return 0, "", fmt.Errorf("invalid IP addr format: %s", ip)
+	}
+	if err := db.Lookup(ipn, &rec); err != nil {
+		return 0, "", err
+	}
+	return rec.ASN, rec.ASOrg, nil
+}
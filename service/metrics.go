@@ -0,0 +1,72 @@
+package service
+
+import (
+	"github.com/gdotgordon/ipverify/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The verify outcomes that are counted.  A request with suspicious travel
+// both to and from its neighbors counts towards both outcomes.
+const (
+	outcomeBlocked              = "blocked"
+	outcomeSuspiciousPreceding  = "suspicious_preceding"
+	outcomeSuspiciousSubsequent = "suspicious_subsequent"
+	outcomeZeroTime             = "zero_time"
+)
+
+var (
+	verifications = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipverify",
+		Name:      "verifications_total",
+		Help:      "Login events evaluated, including dry runs and batch items.",
+	})
+
+	verifyOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipverify",
+		Name:      "verify_outcomes_total",
+		Help: "Evaluated login events that were blocked, had suspicious preceding or " +
+			"subsequent travel, or collided with another event at the same time.",
+	}, []string{"outcome"})
+
+	geoLookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ipverify",
+		Name:      "maxmind_lookup_duration_seconds",
+		Help:      "Maxmind DB lookup latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 8),
+	})
+
+	geoLookupFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipverify",
+		Name:      "maxmind_lookup_failures_total",
+		Help:      "Maxmind DB lookups that failed.",
+	})
+)
+
+func init() {
+	// Export every outcome from the start, so alerts on their rates don't
+	// see missing series.
+	for _, o := range []string{outcomeBlocked, outcomeSuspiciousPreceding,
+		outcomeSuspiciousSubsequent, outcomeZeroTime} {
+		verifyOutcomes.WithLabelValues(o)
+	}
+}
+
+// observeVerify counts the outcome of an evaluated request.
+func observeVerify(resp *types.VerifyResponse) {
+	verifications.Inc()
+	if resp.Blocked {
+		verifyOutcomes.WithLabelValues(outcomeBlocked).Inc()
+	}
+	if ge := resp.PrecedingIPAccess; ge != nil && ge.SuspiciousTravel {
+		verifyOutcomes.WithLabelValues(outcomeSuspiciousPreceding).Inc()
+	}
+	if ge := resp.SubsequentIPAccess; ge != nil && ge.SuspiciousTravel {
+		verifyOutcomes.WithLabelValues(outcomeSuspiciousSubsequent).Inc()
+	}
+
+	// Only an earlier or simultaneous event can be at the same time.
+	if ge := resp.PrecedingIPAccess; ge != nil && ge.Speed == -1 {
+		verifyOutcomes.WithLabelValues(outcomeZeroTime).Inc()
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/ipverify/store"
+	"github.com/gdotgordon/ipverify/types"
+	"go.uber.org/zap"
+)
+
+// DefaultPruneBatchSize is the number of events deleted per batch.  The
+// store is unlocked between batches, so verify requests are not held up
+// for long by a large prune.
+const DefaultPruneBatchSize = 500
+
+// Pruner enforces the data retention policy, periodically deleting events
+// older than the maximum age, and the oldest events of users with more
+// than the maximum number of events.
+type Pruner struct {
+	sync.Mutex
+	store      store.Store
+	log        *zap.SugaredLogger
+	maxAge     time.Duration
+	maxPerUser int
+	batchSize  int
+	stats      types.PruneStats
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// PrunerOption is used to configure the retention policy.
+type PrunerOption func(*Pruner)
+
+// WithMaxAge deletes events older than the duration.
+func WithMaxAge(d time.Duration) PrunerOption {
+	return func(p *Pruner) {
+		p.maxAge = d
+	}
+}
+
+// WithMaxEventsPerUser keeps at most n events for each user.
+func WithMaxEventsPerUser(n int) PrunerOption {
+	return func(p *Pruner) {
+		p.maxPerUser = n
+	}
+}
+
+// WithPruneBatchSize sets the number of events deleted per batch.
+func WithPruneBatchSize(n int) PrunerOption {
+	return func(p *Pruner) {
+		p.batchSize = n
+	}
+}
+
+// NewPruner creates a Pruner for the store.  Without any options, it
+// never deletes anything.
+func NewPruner(store store.Store, log *zap.SugaredLogger, opts ...PrunerOption) *Pruner {
+	p := &Pruner{store: store, log: log, batchSize: DefaultPruneBatchSize}
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+// WithPruner reports the statistics of the pruner enforcing the data
+// retention policy in the service status.
+func WithPruner(p *Pruner) Option {
+	return func(vs *VerifyService) {
+		vs.pruner = p
+	}
+}
+
+// Start prunes the store immediately, and then at each interval, until
+// Stop is called.
+func (p *Pruner) Start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := p.Prune(ctx); err != nil && ctx.Err() == nil {
+				p.log.Errorw("pruning store", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the pruner, cancelling the batch in progress, if any, and
+// waiting for it to be abandoned.  It must be called before the store is
+// shut down.
+func (p *Pruner) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
+
+// Prune deletes the events that are outside the retention policy, a batch
+// at a time, returning the number deleted.  It stops once the context is
+// done.
+func (p *Pruner) Prune(ctx context.Context) (int64, error) {
+	var total int64
+	var err error
+	if p.maxAge > 0 {
+		before := time.Now().Add(-p.maxAge).Unix()
+		total, err = p.pruneBatches(ctx, func() (int64, error) {
+			return p.store.PruneBefore(ctx, before, p.batchSize)
+		})
+	}
+	if err == nil && p.maxPerUser > 0 {
+		// The users with too many events are found once, and then only
+		// their events are read.
+		var users []string
+		users, err = p.store.ExcessUsers(ctx, p.maxPerUser)
+		for _, username := range users {
+			if err != nil {
+				break
+			}
+			var n int64
+			n, err = p.pruneBatches(ctx, func() (int64, error) {
+				return p.store.PruneExcess(ctx, username, p.maxPerUser, p.batchSize)
+			})
+			total += n
+		}
+	}
+
+	p.Lock()
+	p.stats.Runs++
+	p.stats.Deleted += total
+	p.stats.LastRun = time.Now().Unix()
+	p.stats.LastDeleted = total
+	p.Unlock()
+	if total > 0 {
+		p.log.Infow("pruned store", "deleted", total)
+	}
+	return total, err
+}
+
+// pruneBatches calls the prune function until it deletes less than a full
+// batch, or the context is done.
+func (p *Pruner) pruneBatches(ctx context.Context, prune func() (int64, error)) (int64, error) {
+	var total int64
+	for {
+		n, err := prune()
+		total += n
+		if err != nil || n < int64(p.batchSize) {
+			return total, err
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+	}
+}
+
+// Stats returns the totals since the pruner was created, along with the
+// details of the last run.
+func (p *Pruner) Stats() types.PruneStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/ipverify/types"
+)
+
+// DefaultCanaryIP is the address looked up to check that the geolocation
+// database is usable.  It is in the GeoLite2 City database, and also in
+// MaxMind's test databases.
+const DefaultCanaryIP = "81.2.69.142"
+
+const (
+	// countsMaxAge is how long the row counts reported by the readiness
+	// check are reused.  Counting scans the tables, so it is done in the
+	// background rather than by every probe.
+	countsMaxAge = time.Minute
+
+	// countsTimeout limits the time taken to count the rows.
+	countsTimeout = 30 * time.Second
+)
+
+// countsCache holds the last row counts of the store, and when they were
+// taken.
+type countsCache struct {
+	sync.Mutex
+	counts     types.StoreCounts
+	at         time.Time
+	refreshing bool
+}
+
+// WithCanaryIP sets the address looked up by the readiness check, which
+// must have a location in the geolocation database.
+func WithCanaryIP(ip string) Option {
+	return func(vs *VerifyService) {
+		vs.canaryIP = ip
+	}
+}
+
+// Ready checks the dependencies of the service: that the store can be
+// queried, and that the canary address can be geolocated.  Unlike the
+// other methods, problems are reported in the response rather than as an
+// error, so each dependency's state is available.  The store's row counts
+// are the last ones taken, and are refreshed in the background once they
+// are older than a minute.
+func (vs *VerifyService) Ready(ctx context.Context) types.ReadyResponse {
+	resp := types.ReadyResponse{
+		Status: types.Ready,
+		Store:  vs.storeReadiness(ctx),
+		GeoDB:  vs.geoReadiness(),
+	}
+	if resp.Store.Status != types.Ready || resp.GeoDB.Status != types.Ready {
+		resp.Status = types.Degraded
+		vs.log.Warnw("service degraded", "store", resp.Store.Error, "geoDb", resp.GeoDB.Error)
+	}
+	return resp
+}
+
+func (vs *VerifyService) storeReadiness(ctx context.Context) types.StoreReadiness {
+	sr := types.StoreReadiness{Status: types.Ready}
+	if err := vs.store.Ping(ctx); err != nil {
+		sr.Status = types.Degraded
+		sr.Error = err.Error()
+		return sr
+	}
+	var at time.Time
+	sr.StoreCounts, at = vs.cachedCounts()
+	if !at.IsZero() {
+		sr.CountedAt = at.UTC().Format(time.RFC3339)
+	}
+	return sr
+}
+
+// cachedCounts returns the last row counts of the store, and when they
+// were taken, starting a refresh if they are stale.  The time is zero if
+// the rows have not been counted yet.
+func (vs *VerifyService) cachedCounts() (types.StoreCounts, time.Time) {
+	vs.counts.Lock()
+	defer vs.counts.Unlock()
+	if time.Since(vs.counts.at) >= countsMaxAge && !vs.counts.refreshing {
+		vs.counts.refreshing = true
+		go vs.refreshCounts()
+	}
+	return vs.counts.counts, vs.counts.at
+}
+
+// refreshCounts counts the rows of the store for the readiness check.  A
+// failure is only logged, so the next check tries again.
+func (vs *VerifyService) refreshCounts() {
+	ctx, cancel := context.WithTimeout(context.Background(), countsTimeout)
+	defer cancel()
+	counts, err := vs.store.Counts(ctx)
+
+	vs.counts.Lock()
+	defer vs.counts.Unlock()
+	vs.counts.refreshing = false
+	if err != nil {
+		vs.log.Warnw("counting store rows failed", "error", err)
+		return
+	}
+	vs.counts.counts, vs.counts.at = counts, time.Now()
+}
+
+func (vs *VerifyService) geoReadiness() types.GeoDBReadiness {
+	gr := types.GeoDBReadiness{
+		Status:    types.Ready,
+		CanaryIP:  vs.canaryIP,
+		GeoDBInfo: vs.geo.Info(),
+	}
+	if gr.BuildEpoch != 0 {
+		gr.BuildDate = time.Unix(int64(gr.BuildEpoch), 0).UTC().Format(time.RFC3339)
+	}
+
+	// An address that isn't found is not an error for the Maxmind DB, but
+	// the canary is always expected to be there.
+	loc, err := vs.geo.Lookup(vs.canaryIP)
+	if err == nil && loc == (Location{}) {
+		err = fmt.Errorf("canary address %s not found", vs.canaryIP)
+	}
+	if err != nil {
+		gr.Status = types.Degraded
+		gr.Error = err.Error()
+	}
+	return gr
+}
@@ -4,13 +4,15 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"math"
-	"net"
+	"sync"
+	"time"
 
+	"github.com/gdotgordon/ipverify/iplist"
 	"github.com/gdotgordon/ipverify/store"
 	"github.com/gdotgordon/ipverify/types"
-	"github.com/oschwald/maxminddb-golang"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
@@ -21,14 +23,9 @@ const (
 	earthRadius = float64(6371)
 )
 
-// Location is the struct returned by Maxmind DB lookup results.
-type Location struct {
-	AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
-	Latitude       float64 `maxminddb:"latitude"`
-	Longitude      float64 `maxminddb:"longitude"`
-	MetroCode      uint    `maxminddb:"metro_code"`
-	TimeZone       string  `maxminddb:"time_zone"`
-}
+// removeTimeout limits the time taken to remove the stored event of a
+// request that failed.
+const removeTimeout = 5 * time.Second
 
 // Error is used to tag internal server errors to distinguish them from
 // other things, such as user errors.
@@ -38,10 +35,24 @@ func (e Error) Error() string {
 
 type Error string
 
-// Service defines the sets of functions handled by IP verify service
+// Service defines the sets of functions handled by IP verify service.  The
+// functions that use the store take the request's context, and fail with
+// the context's error if it is done before they complete.
 type Service interface {
-	VerifyIP(types.VerifyRequest) (*types.VerifyResponse, error)
-	ResetStore() error
+	VerifyIP(context.Context, types.VerifyRequest) (*types.VerifyResponse, error)
+	VerifyBatch(context.Context, []types.VerifyRequest) []BatchResult
+	GetUserEvents(ctx context.Context, username string,
+		query types.EventQuery) (*types.UserEventsResponse, error)
+	DeleteUser(ctx context.Context, username string) (int64, error)
+	DeleteEvent(ctx context.Context, username string, uuid string) (int64, error)
+	GetDenylist(ctx context.Context) ([]types.DenylistEntry, error)
+	AddDenylistEntry(context.Context, types.DenylistEntry) (types.DenylistEntry, error)
+	RemoveDenylistEntry(ctx context.Context, entry string) error
+	ResetStore(ctx context.Context) (int64, error)
+	ReloadGeoDB() error
+	GeoDBInfo() types.GeoDBInfo
+	PruneStats() *types.PruneStats
+	Ready(ctx context.Context) types.ReadyResponse
 }
 
 // VerifyService is the implementation of Service that performs verification
@@ -50,115 +61,534 @@ type Service interface {
 // the incoming request against previously recorded events in the database,
 // determining whether the request is suspicious.
 type VerifyService struct {
-	mmReader *maxminddb.Reader
-	store    store.Store
-	log      *zap.SugaredLogger
+	geo           Geolocator
+	store         store.Store
+	log           *zap.SugaredLogger
+	maxSpeed      types.SpeedThreshold
+	groupMaxSpeed map[string]types.SpeedThreshold
+	sameASNFactor float64
+	anonymity     *AnonymityChecker
+	trustedNets   *iplist.Set
+	trustMode     TrustMode
+	denyFile      *iplist.Set
+	denyMu        sync.RWMutex
+	denyAPI       *iplist.Set
+	pruner        *Pruner
+	canaryIP      string
+	counts        countsCache
 }
 
-// New creates a new VerifyService, configured with a datastore and logger.
-func New(mmDBPath string, store store.Store, log *zap.SugaredLogger) (*VerifyService, error) {
-	mmReader, err := maxminddb.Open(mmDBPath)
-	if err != nil {
-		return nil, Error(err.Error())
+// TrustMode determines how events from trusted networks, such as corporate
+// VPN egress addresses, are treated.  These typically geolocate to the
+// company's headquarters regardless of where the user actually is.
+type TrustMode string
+
+const (
+	// TrustExclude stores events from trusted networks, but never uses them
+	// as the preceding or subsequent access.  An event from a trusted
+	// network is not compared to its neighbors at all.
+	TrustExclude TrustMode = "exclude"
+
+	// TrustNeverFlag compares events from trusted networks as usual, but
+	// never flags travel to or from them as suspicious.
+	TrustNeverFlag TrustMode = "never-flag"
+)
+
+// ParseTrustMode converts a string to a TrustMode, returning an error if
+// the mode is not supported.
+func ParseTrustMode(s string) (TrustMode, error) {
+	switch m := TrustMode(s); m {
+	case TrustExclude, TrustNeverFlag:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid trust mode: %s", s)
+	}
+}
+
+// Option is used to configure optional settings of the VerifyService.
+type Option func(*VerifyService)
+
+// WithMaxSpeed sets the default suspicious-speed threshold.
+func WithMaxSpeed(speed float64, unit types.SpeedUnit) Option {
+	return func(vs *VerifyService) {
+		vs.maxSpeed = types.SpeedThreshold{Speed: speed, Unit: unit}
+	}
+}
+
+// WithGroupMaxSpeed sets a suspicious-speed threshold for the named user
+// group, which overrides the default for requests that specify that group.
+func WithGroupMaxSpeed(group string, speed float64, unit types.SpeedUnit) Option {
+	return func(vs *VerifyService) {
+		vs.groupMaxSpeed[group] = types.SpeedThreshold{Speed: speed, Unit: unit, Group: group}
 	}
-	return &VerifyService{mmReader: mmReader, store: store, log: log}, nil
+}
+
+// WithSameASNFactor softens the impossible-travel verdict for consecutive
+// logins from the same autonomous system, such as a mobile carrier re-homing
+// IP addresses, by multiplying the speed threshold by the factor.
+func WithSameASNFactor(factor float64) Option {
+	return func(vs *VerifyService) {
+		vs.sameASNFactor = factor
+	}
+}
+
+// WithAnonymityChecker enables flagging of logins from anonymizers, hosting
+// providers and Tor exit nodes.
+func WithAnonymityChecker(ac *AnonymityChecker) Option {
+	return func(vs *VerifyService) {
+		vs.anonymity = ac
+	}
+}
+
+// WithTrustedNetworks sets the trusted networks and how events from them
+// are treated.
+func WithTrustedNetworks(set *iplist.Set, mode TrustMode) Option {
+	return func(vs *VerifyService) {
+		vs.trustedNets = set
+		vs.trustMode = mode
+	}
+}
+
+// New creates a new VerifyService, configured with a geolocator, datastore
+// and logger.
+func New(geo Geolocator, store store.Store, log *zap.SugaredLogger,
+	opts ...Option) (*VerifyService, error) {
+	vs := &VerifyService{
+		geo:           geo,
+		store:         store,
+		log:           log,
+		maxSpeed:      types.SpeedThreshold{Speed: types.MaxSpeed, Unit: types.DefaultSpeedUnit},
+		groupMaxSpeed: make(map[string]types.SpeedThreshold),
+		sameASNFactor: 1,
+		denyAPI:       iplist.New(),
+		canaryIP:      DefaultCanaryIP,
+	}
+	for _, o := range opts {
+		o(vs)
+	}
+	if err := vs.loadDenylist(context.Background()); err != nil {
+		return nil, err
+	}
+	return vs, nil
 }
 
 // VerifyIP is the main call to check for suspicious activity, given the current
-// incoming login.
-func (vs *VerifyService) VerifyIP(req types.VerifyRequest) (*types.VerifyResponse, error) {
+// incoming login.  A dry run request is checked against the stored events
+// in the same way, but is not itself recorded.  A request that fails after
+// it has been added, for example because its context is done, is removed
+// again, so it may be retried with the same UUID.
+func (vs *VerifyService) VerifyIP(ctx context.Context,
+	req types.VerifyRequest) (*types.VerifyResponse, error) {
 
-	// First add the current record to the store.  This will reduce the vulnerability
-	// of two nearly simultaneous requests missing each other's new event.
-	if err := vs.store.AddRecord(req); err != nil {
-		return nil, errors.Wrap(err, "add record to store")
+	// First add the current record to the store, along with its location.
+	// This will reduce the vulnerability of two nearly simultaneous requests
+	// missing each other's new event.
+	if !req.DryRun {
+		if err := vs.locate(&req); err != nil {
+			return nil, err
+		}
+		if err := vs.store.AddRecord(ctx, req); err != nil {
+			return nil, errors.Wrap(contextError(ctx, err), "add record to store")
+		}
+	}
+	resp, err := vs.evaluate(ctx, req)
+	if err != nil {
+		if !req.DryRun {
+			vs.removeRecord(req.EventUUID)
+		}
+		return nil, err
+	}
+	if !req.DryRun {
+		vs.recordVerdict(ctx, req.EventUUID, resp)
+	}
+	return resp, nil
+}
+
+// locate looks up the location of the request's address, to be recorded
+// with the event.  Denylisted addresses are blocked without geolocation,
+// so they aren't looked up.
+func (vs *VerifyService) locate(req *types.VerifyRequest) error {
+	if _, ok := vs.denylisted(req.IPAddress); ok {
+		return nil
+	}
+	loc, err := vs.geo.Lookup(req.IPAddress)
+	if err != nil {
+		return errors.Wrap(err, "IP lookup")
+	}
+	req.Geo = &types.EventGeo{
+		CurrentGeoStat: currentGeo(loc),
+		BuildEpoch:     vs.geo.Info().BuildEpoch,
+	}
+	return nil
+}
+
+// eventLocation gets the location of an event: the one recorded with it,
+// if any, so the verdict doesn't change with the geolocation database, and
+// otherwise a fresh lookup.
+func (vs *VerifyService) eventLocation(event *types.VerifyRequest) (Location, error) {
+	if event.Geo != nil {
+		return locationFromGeo(event.Geo.CurrentGeoStat), nil
+	}
+	return vs.geo.Lookup(event.IPAddress)
+}
+
+// recordVerdict records the verdict with the stored event.  The caller
+// gets the verdict either way, so a failure is only logged.
+func (vs *VerifyService) recordVerdict(ctx context.Context, uuid string,
+	resp *types.VerifyResponse) {
+	if err := vs.store.RecordVerdict(ctx, uuid, eventVerdict(resp)); err != nil {
+		vs.log.Warnw("recording verdict failed", "uuid", uuid, "error", err)
+	}
+}
+
+// removeRecord takes back the stored event of a request that could not be
+// evaluated, for example because its deadline passed, so that the request
+// may be retried with the same UUID.  The request's context may be done,
+// so the removal has its own deadline, and a failure is only logged.
+func (vs *VerifyService) removeRecord(uuid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+	if err := vs.store.RemoveRecord(ctx, uuid); err != nil {
+		vs.log.Warnw("removing record of failed request failed", "uuid", uuid, "error", err)
+	}
+}
+
+// evaluate checks a request that has already been added to the store
+// against its neighbors.
+func (vs *VerifyService) evaluate(ctx context.Context,
+	req types.VerifyRequest) (*types.VerifyResponse, error) {
+
+	// Logins from denylisted addresses are blocked outright, without any
+	// geolocation.
+	if entry, ok := vs.denylisted(req.IPAddress); ok {
+		resp := &types.VerifyResponse{
+			DryRun:    req.DryRun,
+			Blocked:   true,
+			RiskScore: 100,
+			RiskLevel: types.HighRisk,
+			Reasons:   []types.Reason{{Code: types.ReasonDenylisted, Detail: entry}},
+		}
+		observeVerify(resp)
+		return resp, nil
 	}
 
 	// A GeoEvent is the data for the previous and next requests relative
 	// to the incoming request.  Both may or may bot be present.
 	var pge, nge *types.GeoEvent
-	var resp types.VerifyResponse
+	resp := types.VerifyResponse{DryRun: req.DryRun}
 
-	// Now get the prior and next items (if they exist) from the store.
-	prev, nxt, err := vs.store.GetPriorNext(req.Username, req.EventUUID, req.UnixTimestamp)
+	// Check whether the incoming request is from a trusted network.
+	curTrusted := false
+	if entry, ok := vs.trustedEntry(req.IPAddress); ok {
+		curTrusted = true
+		addReason(&resp, types.Reason{Code: types.ReasonTrustedNetwork, Detail: entry})
+	}
+
+	// Now get the prior and next items (if they exist) from the store.  When
+	// excluding trusted networks, skip over any events from them, and don't
+	// compare an event from a trusted network at all.
+	var prev, nxt *types.VerifyRequest
+	var err error
+	switch {
+	case vs.trustedNets == nil || vs.trustMode != TrustExclude:
+		prev, nxt, err = vs.store.GetPriorNext(ctx, req.Username, req.EventUUID,
+			req.UnixTimestamp)
+	case !curTrusted:
+		prev, nxt, err = vs.store.GetPriorNextMatching(ctx, req.Username, req.EventUUID,
+			req.UnixTimestamp, func(r types.VerifyRequest) bool {
+				entry, ok := vs.trustedEntry(r.IPAddress)
+				if ok {
+					addReason(&resp, types.Reason{Code: types.ReasonTrustedNetwork, Detail: entry})
+				}
+				return !ok
+			})
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "getting prior and subsequent records")
+		return nil, errors.Wrap(contextError(ctx, err), "getting prior and subsequent records")
 	}
 
 	// Get the coordinates and radius for the incoming request.
-	curLoc, err := lookupIP(req.IPAddress, vs.mmReader, vs.log)
+	curLoc, err := vs.eventLocation(&req)
 	if err != nil {
 		return nil, errors.Wrap(err, "IP lookup")
 	}
 
+	// Determine which speed threshold applies to this request.
+	threshold := vs.thresholdFor(req)
+	resp.Threshold = threshold
+
 	// Fill in the part of the response object for the current request.
-	resp.CurrentGeo.Lat = curLoc.Latitude
-	resp.CurrentGeo.Lon = curLoc.Longitude
-	resp.CurrentGeo.Radius = curLoc.AccuracyRadius
+	resp.CurrentGeo = currentGeo(curLoc)
+
+	// Check for anonymizers, which is independent of the travel speed.
+	if vs.anonymity != nil {
+		anon, err := vs.anonymity.Check(req.IPAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "anonymity check")
+		}
+		resp.AnonymousProxy = anon.AnonymousProxy
+		resp.Hosting = anon.Hosting
+		resp.TorExit = anon.TorExit
+		for _, r := range anon.Reasons {
+			addReason(&resp, r)
+		}
+	}
 
 	// Compute the speeds and preapre the response section for the previous
 	// and next items (if any).
 	if prev != nil {
-		pge, err = vs.geoEventFromRequest(curLoc, &req, prev)
+		pge, err = vs.geoEventFromRequest(curLoc, &req, prev, threshold, &resp)
 		if err != nil {
 			return nil, errors.Wrap(err, "preparing return data")
 		}
 	}
 	if nxt != nil {
-		nge, err = vs.geoEventFromRequest(curLoc, &req, nxt)
+		nge, err = vs.geoEventFromRequest(curLoc, &req, nxt, threshold, &resp)
 		if err != nil {
 			return nil, errors.Wrap(err, "calculating verify data")
 		}
 	}
 	resp.PrecedingIPAccess = pge
 	resp.SubsequentIPAccess = nge
+	for _, ge := range []*types.GeoEvent{pge, nge} {
+		if ge != nil && ge.RiskScore > resp.RiskScore {
+			resp.RiskScore = ge.RiskScore
+		}
+	}
+	resp.RiskLevel = types.RiskLevelFor(resp.RiskScore)
+	observeVerify(&resp)
 	return &resp, nil
 }
 
-// ResetStore clears the database.
-func (vs *VerifyService) ResetStore() error {
-	if err := vs.store.Clear(); err != nil {
-		return Error(err.Error())
+// ResetStore clears the database, returning the number of events deleted.
+func (vs *VerifyService) ResetStore(ctx context.Context) (int64, error) {
+	n, err := vs.store.Clear(ctx)
+	if err != nil {
+		return 0, storeError(ctx, err)
 	}
-	return nil
+	vs.log.Warnw("Reset database", "deleted", n)
+	return n, nil
+}
+
+// ReloadGeoDB reloads the geolocation database, if the geolocator
+// supports it.  A geolocator that can't be reloaded is a server error,
+// since the request itself is fine.
+func (vs *VerifyService) ReloadGeoDB() error {
+	r, ok := vs.geo.(Reloader)
+	if !ok {
+		return Error("geolocator does not support reloading")
+	}
+	return r.Reload()
+}
+
+// GeoDBInfo describes the geolocation database in use.
+func (vs *VerifyService) GeoDBInfo() types.GeoDBInfo {
+	return vs.geo.Info()
+}
+
+// PruneStats returns the data retention statistics, or nil if no
+// retention policy is configured.
+func (vs *VerifyService) PruneStats() *types.PruneStats {
+	if vs.pruner == nil {
+		return nil
+	}
+	stats := vs.pruner.Stats()
+	return &stats
 }
 
 // Shutdown does cleanup tasks.
 func (vs *VerifyService) Shutdown() {
-	if err := vs.mmReader.Close(); err != nil {
-		vs.log.Warnw("Maxmind shutdown", "error", err)
+	if err := vs.geo.Close(); err != nil {
+		vs.log.Warnw("geolocator shutdown", "error", err)
+	}
+	if vs.anonymity != nil {
+		if err := vs.anonymity.Close(); err != nil {
+			vs.log.Warnw("anonymity checker shutdown", "error", err)
+		}
 	}
 	vs.store.Shutdown()
 }
 
+// thresholdFor determines the suspicious-speed threshold for the request.
+// An explicit override in the request wins, followed by the threshold for
+// the request's user group (if configured), and finally the default.
+func (vs *VerifyService) thresholdFor(req types.VerifyRequest) types.SpeedThreshold {
+	if req.MaxSpeed > 0 {
+		// The unit may be given in any case, so it is converted to the
+		// canonical one the threshold is compared in.
+		unit := vs.maxSpeed.Unit
+		if u, err := types.ParseSpeedUnit(string(req.SpeedUnit)); err == nil {
+			unit = u
+		}
+		return types.SpeedThreshold{Speed: req.MaxSpeed, Unit: unit}
+	}
+	if t, ok := vs.groupMaxSpeed[req.UserGroup]; ok {
+		return t
+	}
+	return vs.maxSpeed
+}
+
+// trustedEntry returns the trusted network entry containing the IP
+// address, if any.
+func (vs *VerifyService) trustedEntry(ip string) (string, bool) {
+	if vs.trustedNets == nil {
+		return "", false
+	}
+	return vs.trustedNets.ContainsString(ip)
+}
+
+// contextError returns the context's error if it is done, since that is
+// the underlying cause of any error from the store, and otherwise err.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// storeError tags an error from the store as an internal server error,
+// unless it was caused by the context being done.
+func storeError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return Error(err.Error())
+}
+
+// addReason adds a reason to the response, unless it is already present.
+func addReason(resp *types.VerifyResponse, reason types.Reason) {
+	for _, r := range resp.Reasons {
+		if r == reason {
+			return
+		}
+	}
+	resp.Reasons = append(resp.Reasons, reason)
+}
+
+// currentGeo converts a location to the response form.
+func currentGeo(loc Location) types.CurrentGeoStat {
+	return types.CurrentGeoStat{
+		Lat:         loc.Latitude,
+		Lon:         loc.Longitude,
+		Radius:      loc.AccuracyRadius,
+		Country:     loc.CountryCode,
+		Subdivision: loc.Subdivision,
+		City:        loc.City,
+		TimeZone:    loc.TimeZone,
+		ASN:         loc.ASN,
+		ASOrg:       loc.ASOrg,
+	}
+}
+
+// locationFromGeo converts the response form of a location back to a Location.
+func locationFromGeo(geo types.CurrentGeoStat) Location {
+	return Location{
+		Latitude:       geo.Lat,
+		Longitude:      geo.Lon,
+		AccuracyRadius: geo.Radius,
+		CountryCode:    geo.Country,
+		Subdivision:    geo.Subdivision,
+		City:           geo.City,
+		TimeZone:       geo.TimeZone,
+		ASN:            geo.ASN,
+		ASOrg:          geo.ASOrg,
+	}
+}
+
+// eventVerdict converts a response to the verdict recorded with the event.
+func eventVerdict(resp *types.VerifyResponse) types.EventVerdict {
+	return types.EventVerdict{
+		Blocked:    resp.Blocked,
+		RiskScore:  resp.RiskScore,
+		RiskLevel:  resp.RiskLevel,
+		Threshold:  resp.Threshold,
+		Preceding:  travelVerdict(resp.PrecedingIPAccess),
+		Subsequent: travelVerdict(resp.SubsequentIPAccess),
+		Reasons:    resp.Reasons,
+	}
+}
+
+func travelVerdict(ge *types.GeoEvent) *types.TravelVerdict {
+	if ge == nil {
+		return nil
+	}
+	return &types.TravelVerdict{
+		IP:               ge.IP,
+		Timestamp:        ge.Timestamp,
+		Speed:            ge.Speed,
+		AdjustedSpeed:    ge.AdjustedSpeed,
+		SuspiciousTravel: ge.SuspiciousTravel,
+		RiskScore:        ge.RiskScore,
+	}
+}
+
 // geoEventFromRequest prepares either the "previous" and "subsequent" part
 // of the response item, given the data.  This is mostly to refactor common
-// code.
+// code.  Any rules that apply are added to the reasons in the response.
 func (vs *VerifyService) geoEventFromRequest(curLoc Location,
-	curEvent, otherEvent *types.VerifyRequest) (*types.GeoEvent, error) {
+	curEvent, otherEvent *types.VerifyRequest,
+	threshold types.SpeedThreshold, resp *types.VerifyResponse) (*types.GeoEvent, error) {
 
-	otherLoc, err := lookupIP(otherEvent.IPAddress, vs.mmReader, vs.log)
+	otherLoc, err := vs.eventLocation(otherEvent)
 	if err != nil {
 		return nil, err
 	}
 
-	speed := calculateSpeed(otherLoc.Latitude, otherLoc.Longitude,
-		otherEvent.UnixTimestamp, curLoc.Latitude, curLoc.Longitude,
-		curEvent.UnixTimestamp)
+	speed, adjSpeed := calculateSpeeds(otherLoc.Latitude, otherLoc.Longitude,
+		otherLoc.AccuracyRadius, otherEvent.UnixTimestamp, curLoc.Latitude,
+		curLoc.Longitude, curLoc.AccuracyRadius, curEvent.UnixTimestamp)
+
+	// Consecutive logins from the same autonomous system may be given more
+	// leeway, if so configured.
+	limit := threshold.InMilesPerHour()
+	sameASN := curLoc.ASN != 0 && curLoc.ASN == otherLoc.ASN
+	if sameASN {
+		limit *= vs.sameASNFactor
+	}
 
 	// As documented in the readme, we use the special value -1 for the 0 time
-	// situation (two events at exactly he same Unix time).
+	// situation (two events at exactly he same Unix time).  Otherwise, the
+	// verdict is based on the minimum plausible speed, which accounts for the
+	// accuracy radius of both locations.
 	var suspicious bool
-	if speed == -1 || speed > types.MaxSpeed {
+	if adjSpeed == -1 || float64(adjSpeed) > limit {
 		suspicious = true
 	}
+	score := riskScore(speed, adjSpeed, limit,
+		curEvent.UnixTimestamp-otherEvent.UnixTimestamp)
+
+	// Travel to or from a trusted network is never flagged, if so configured.
+	var trusted bool
+	if vs.trustMode == TrustNeverFlag {
+		for _, ip := range []string{curEvent.IPAddress, otherEvent.IPAddress} {
+			if entry, ok := vs.trustedEntry(ip); ok {
+				trusted = true
+				addReason(resp, types.Reason{Code: types.ReasonTrustedNetwork, Detail: entry})
+			}
+		}
+		if trusted {
+			suspicious = false
+			score = 0
+		}
+	}
 	ge := types.GeoEvent{
 		Speed:            speed,
+		AdjustedSpeed:    adjSpeed,
 		SuspiciousTravel: suspicious,
+		RiskScore:        score,
+		RiskLevel:        types.RiskLevelFor(score),
 		IP:               otherEvent.IPAddress,
 		Lat:              otherLoc.Latitude,
 		Lon:              otherLoc.Longitude,
 		Radius:           otherLoc.AccuracyRadius,
+		Country:          otherLoc.CountryCode,
+		Subdivision:      otherLoc.Subdivision,
+		City:             otherLoc.City,
+		TimeZone:         otherLoc.TimeZone,
+		ASN:              otherLoc.ASN,
+		ASOrg:            otherLoc.ASOrg,
+		SameASN:          sameASN,
+		Trusted:          trusted,
 		Timestamp:        otherEvent.UnixTimestamp,
 	}
 	return &ge, nil
@@ -168,18 +598,75 @@ func (vs *VerifyService) geoEventFromRequest(curLoc Location,
 // to calculte a rate that is rounded to the nearest integer (as per the sample
 // in the assignment).
 func calculateSpeed(lat1, lon1 float64, time1 int64, lat2, lon2 float64, time2 int64) int64 {
+	speed, _ := calculateSpeeds(lat1, lon1, 0, time1, lat2, lon2, 0, time2)
+	return speed
+}
+
+// calculateSpeeds returns both the raw speed between the two centroids and
+// the minimum plausible speed.  The latter subtracts both accuracy radii
+// (which MaxMind reports in kilometers) from the distance, floored at zero,
+// so two logins whose circles of uncertainty overlap are never considered
+// to have moved at all.
+func calculateSpeeds(lat1, lon1 float64, radius1 uint16, time1 int64,
+	lat2, lon2 float64, radius2 uint16, time2 int64) (int64, int64) {
 	dist := haversine(lat1, lon1, lat2, lon2)
+	minDist := math.Max(0, dist-kmtomiles*(float64(radius1)+float64(radius2)))
 
 	// We don't want to divide by 0, so we use -1 as an indicator for this.
 	if time1 == time2 {
-		return -1
+		return -1, -1
 	}
 	t := math.Abs(float64(time2 - time1))
 
 	// This calcuation is distance ((miles) * (sec/hr)) / sec = speed in miles/hr
 	// It seems less prone to underflow than (dist/t) * 3600, given that the earth's
 	// circumference is around 25 K miles, and a week of seconds is about the same number.
-	return int64(math.Round((dist * 3600) / t))
+	return int64(math.Round((dist * 3600) / t)), int64(math.Round((minDist * 3600) / t))
+}
+
+// riskScore grades the travel between two logins on a scale of 0-100.
+// The score is mostly driven by the adjusted speed relative to the
+// threshold, such that reaching the threshold is just high risk.  Short
+// time gaps add to the score, as there is less opportunity for legitimate
+// travel.  The score is then dampened in proportion to how much of the
+// raw distance is within the accuracy radii, as those are the cases where
+// the locations are least trustworthy.  Finally, the score is kept at or
+// above the high risk floor if the adjusted speed reaches the threshold,
+// and below it otherwise, so that neither the time gap nor the dampening
+// moves the travel across it.  Simultaneous logins get the maximum score,
+// consistent with them always being flagged as suspicious.
+func riskScore(speed, adjSpeed int64, maxSpeed float64, gap int64) int {
+	if adjSpeed == -1 {
+		return 100
+	}
+	if speed <= 0 || maxSpeed <= 0 {
+		return 0
+	}
+
+	score := math.Min(90, types.RiskHigh*float64(adjSpeed)/maxSpeed)
+	if adjSpeed > 0 {
+		switch gap = absInt64(gap); {
+		case gap < 3600:
+			score += 10
+		case gap < 6*3600:
+			score += 5
+		}
+	}
+	uncertainty := float64(speed-adjSpeed) / float64(speed)
+	score *= 1 - uncertainty/2
+	if float64(adjSpeed) >= maxSpeed {
+		score = math.Max(score, types.RiskHigh)
+	} else {
+		score = math.Min(score, types.RiskHigh-1)
+	}
+	return int(math.Round(math.Max(0, math.Min(100, score))))
+}
+
+func absInt64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
 }
 
 // Source: // https://play.golang.org/p/MZVh5bRWqN - basic code similar to these
@@ -197,23 +684,3 @@ func haversine(latFrom, lonFrom, latTo, lonTo float64) float64 {
 
 	return kmtomiles * (earthRadius * c)
 }
-
-// lookupIP does a MaxMind lookup, using the more efficient lower-level API.
-func lookupIP(ip string, db *maxminddb.Reader, log *zap.SugaredLogger) (Location, error) {
-	// Syntactic weirdness due to using recommended low-level API, which
-	// requires a struct tag.
-	var loc struct {
-		Loc Location `maxminddb:"location"`
-	}
-
-	ipn := net.ParseIP(ip)
-	if ipn == nil {
-		log.Errorw("bad IP address not caught by validation", "IPaddr", ip)
-		return loc.Loc, fmt.Errorf("invalid IP addr format: %s", ip)
-	}
-	err := db.Lookup(ipn, &loc)
-	if err != nil {
-		return loc.Loc, err
-	}
-	return loc.Loc, nil
-}
@@ -1,44 +1,68 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gdotgordon/ipverify/iplist"
 	"github.com/gdotgordon/ipverify/store"
 	"github.com/gdotgordon/ipverify/types"
 	"github.com/google/uuid"
 	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
 )
 
+const mmdbPath = "../mmdb/GeoLite2-City.mmdb"
+
 func TestMaxMind(t *testing.T) {
-	db, err := maxminddb.Open("../mmdb/GeoLite2-City.mmdb")
+	// The Maxmind DB is not checked in everywhere, so only test the real
+	// lookups when it is present.
+	if _, err := os.Stat(mmdbPath); os.IsNotExist(err) {
+		t.Skipf("%s not present", mmdbPath)
+	}
+	db, err := maxminddb.Open(mmdbPath)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer db.Close()
 
 	log := newNoopLogger()
 	for i, v := range []struct {
-		ipAddr    string
-		expLat    float64
-		expLong   float64
-		expRadius uint16
-		expErr    bool
-		expErrStr string
+		ipAddr     string
+		expLat     float64
+		expLong    float64
+		expRadius  uint16
+		expCountry string
+		expSubdiv  string
+		expCity    string
+		expErr     bool
+		expErrStr  string
 	}{
 		{
-			ipAddr:    "128.148.252.151",
-			expLat:    41.8244,
-			expLong:   -71.408,
-			expRadius: 5,
+			ipAddr:     "128.148.252.151",
+			expLat:     41.8244,
+			expLong:    -71.408,
+			expRadius:  5,
+			expCountry: "US",
+			expSubdiv:  "Rhode Island",
+			expCity:    "Providence",
 		},
 		{
-			ipAddr:    "131.91.101.181",
-			expLat:    26.3796,
-			expLong:   -80.1029,
-			expRadius: 5,
+			ipAddr:     "131.91.101.181",
+			expLat:     26.3796,
+			expLong:    -80.1029,
+			expRadius:  5,
+			expCountry: "US",
+			expSubdiv:  "Florida",
+			expCity:    "Boca Raton",
 		},
 		{
 			ipAddr:    "131.91.101",
@@ -46,7 +70,7 @@ func TestMaxMind(t *testing.T) {
 			expErrStr: "invalid IP addr format: 131.91.101",
 		},
 	} {
-		loc, err := lookupIP(v.ipAddr, db, log)
+		loc, err := lookupIP(v.ipAddr, db, DefaultLocale, log)
 		if err != nil {
 			if !v.expErr {
 				t.Errorf("(%d) expected no error, got %v", i, err)
@@ -62,6 +86,39 @@ func TestMaxMind(t *testing.T) {
 		if loc.AccuracyRadius != v.expRadius {
 			t.Errorf("(%d) expected radius %d, got %d", i, v.expRadius, loc.AccuracyRadius)
 		}
+		if loc.CountryCode != v.expCountry || loc.Subdivision != v.expSubdiv || loc.City != v.expCity {
+			t.Errorf("(%d) expected place %s/%s/%s, got %s/%s/%s", i, v.expCountry,
+				v.expSubdiv, v.expCity, loc.CountryCode, loc.Subdivision, loc.City)
+		}
+	}
+}
+
+func TestMaxMindReload(t *testing.T) {
+	if _, err := os.Stat(mmdbPath); os.IsNotExist(err) {
+		t.Skipf("%s not present", mmdbPath)
+	}
+	geo, err := NewMaxMindGeolocator(mmdbPath, newNoopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+
+	before := geo.Info()
+	if before.Type == "" || before.BuildEpoch == 0 {
+		t.Errorf("expected database info, got %+v", before)
+	}
+	if err := geo.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if after := geo.Info(); after != before {
+		t.Errorf("expected database info %+v after reload, got %+v", before, after)
+	}
+	loc, err := geo.Lookup("128.148.252.151")
+	if err != nil {
+		t.Fatalf("lookup after reload failed: %v", err)
+	}
+	if loc.Latitude != 41.8244 || loc.Longitude != -71.408 {
+		t.Errorf("unexpected location after reload: %+v", loc)
 	}
 }
 
@@ -110,12 +167,217 @@ func TestSpeed(t *testing.T) {
 	}
 }
 
+func TestAdjustedSpeed(t *testing.T) {
+	for i, v := range []struct {
+		lat1     float64
+		long1    float64
+		rad1     uint16
+		lat2     float64
+		long2    float64
+		rad2     uint16
+		t1       int64
+		t2       int64
+		expSpeed int64
+		expAdj   int64
+	}{
+		{
+			lat1:     41.8244,
+			long1:    -71.408,
+			rad1:     5,
+			lat2:     26.3796,
+			long2:    -80.1029,
+			rad2:     5,
+			t1:       1514851200,
+			t2:       1514858400,
+			expSpeed: 588,
+			expAdj:   585,
+		},
+		{
+			lat1:     41.8244,
+			long1:    -71.408,
+			rad1:     1000,
+			lat2:     26.3796,
+			long2:    -80.1029,
+			rad2:     1000,
+			t1:       1514851200,
+			t2:       1514858400,
+			expSpeed: 588,
+			expAdj:   0,
+		},
+		{
+			lat1:     51.45,
+			long1:    -1.15,
+			rad1:     100,
+			lat2:     45.04,
+			long2:    7.42,
+			rad2:     200,
+			t1:       1514858400,
+			t2:       1514851200,
+			expSpeed: 296,
+			expAdj:   203,
+		},
+		{
+			lat1:     51.45,
+			long1:    -1.15,
+			rad1:     100,
+			lat2:     45.04,
+			long2:    7.42,
+			rad2:     200,
+			t1:       1514858400,
+			t2:       1514858400,
+			expSpeed: -1,
+			expAdj:   -1,
+		},
+	} {
+		speed, adj := calculateSpeeds(v.lat1, v.long1, v.rad1, v.t1, v.lat2, v.long2, v.rad2, v.t2)
+		if speed != v.expSpeed {
+			t.Errorf("(%d) Expected speed %d, got %d", i, v.expSpeed, speed)
+		}
+		if adj != v.expAdj {
+			t.Errorf("(%d) Expected adjusted speed %d, got %d", i, v.expAdj, adj)
+		}
+	}
+}
+
+func TestRiskScore(t *testing.T) {
+	for i, v := range []struct {
+		speed    int64
+		adjSpeed int64
+		gap      int64
+		expScore int
+		expLevel types.RiskLevel
+	}{
+		{speed: -1, adjSpeed: -1, gap: 0, expScore: 100, expLevel: types.HighRisk},
+		{speed: 0, adjSpeed: 0, gap: 3600, expScore: 0, expLevel: types.LowRisk},
+		{speed: 250, adjSpeed: 250, gap: 24 * 3600, expScore: 35, expLevel: types.LowRisk},
+		{speed: 250, adjSpeed: 250, gap: 1800, expScore: 45, expLevel: types.MediumRisk},
+		{speed: 500, adjSpeed: 500, gap: 24 * 3600, expScore: 70, expLevel: types.HighRisk},
+		{speed: 2000, adjSpeed: 2000, gap: 1800, expScore: 100, expLevel: types.HighRisk},
+		{speed: 1000, adjSpeed: 0, gap: 1800, expScore: 0, expLevel: types.LowRisk},
+		{speed: 1000, adjSpeed: 500, gap: 2 * 3600, expScore: 70, expLevel: types.HighRisk},
+		{speed: 1000, adjSpeed: 499, gap: 2 * 3600, expScore: 56, expLevel: types.MediumRisk},
+		{speed: 499, adjSpeed: 499, gap: 24 * 3600, expScore: 69, expLevel: types.MediumRisk},
+		{speed: 499, adjSpeed: 499, gap: 1800, expScore: 69, expLevel: types.MediumRisk},
+	} {
+		score := riskScore(v.speed, v.adjSpeed, 500, v.gap)
+		if score != v.expScore {
+			t.Errorf("(%d) expected score %d, got %d", i, v.expScore, score)
+		}
+		if level := types.RiskLevelFor(score); level != v.expLevel {
+			t.Errorf("(%d) expected level %s, got %s", i, v.expLevel, level)
+		}
+	}
+}
+
+func TestStaticGeolocator(t *testing.T) {
+	geo := NewStaticGeolocator(map[string]Location{
+		"2001:0db8::0001": makeLoc(coords{41.8244, -71.408}, 5),
+		"131.91.101.181":  makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+	for i, v := range []struct {
+		ipAddr    string
+		expLoc    Location
+		expErrStr string
+	}{
+		{ipAddr: "131.91.101.181", expLoc: makeLoc(coords{26.3796, -80.1029}, 5)},
+		{ipAddr: "2001:db8::1", expLoc: makeLoc(coords{41.8244, -71.408}, 5)},
+		{ipAddr: "128.97.27.37"},
+		{ipAddr: "131.91.101", expErrStr: "invalid IP addr format: 131.91.101"},
+	} {
+		loc, err := geo.Lookup(v.ipAddr)
+		if err != nil {
+			if v.expErrStr == "" {
+				t.Errorf("(%d) expected no error, got %v", i, err)
+			} else if err.Error() != v.expErrStr {
+				t.Errorf("(%d) expected error '%s', got '%s'", i, v.expErrStr, err)
+			}
+			continue
+		}
+		if loc != v.expLoc {
+			t.Errorf("(%d) expected location %+v, got %+v", i, v.expLoc, loc)
+		}
+	}
+
+	// A static geolocator can't be reloaded, which is a server error.
+	l := newNoopLogger()
+	ms, err := store.NewMemoryStore("", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	srv, err := New(geo, ms, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+	var se Error
+	if err := srv.ReloadGeoDB(); !errors.As(err, &se) {
+		t.Errorf("expected service error, got %v", err)
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	vs := &VerifyService{groupMaxSpeed: make(map[string]types.SpeedThreshold)}
+	WithMaxSpeed(800, types.KilometersPerHour)(vs)
+	WithGroupMaxSpeed("travel", 1000, types.KilometersPerHour)(vs)
+
+	for i, v := range []struct {
+		req    types.VerifyRequest
+		expThr types.SpeedThreshold
+		expMPH float64
+	}{
+		{
+			req:    types.VerifyRequest{},
+			expThr: types.SpeedThreshold{Speed: 800, Unit: types.KilometersPerHour},
+			expMPH: 497.0969536,
+		},
+		{
+			req:    types.VerifyRequest{UserGroup: "travel"},
+			expThr: types.SpeedThreshold{Speed: 1000, Unit: types.KilometersPerHour, Group: "travel"},
+			expMPH: 621.371192,
+		},
+		{
+			req:    types.VerifyRequest{UserGroup: "unknown"},
+			expThr: types.SpeedThreshold{Speed: 800, Unit: types.KilometersPerHour},
+			expMPH: 497.0969536,
+		},
+		{
+			req:    types.VerifyRequest{UserGroup: "travel", MaxSpeed: 300},
+			expThr: types.SpeedThreshold{Speed: 300, Unit: types.KilometersPerHour},
+			expMPH: 186.4113576,
+		},
+		{
+			req:    types.VerifyRequest{MaxSpeed: 300, SpeedUnit: types.MilesPerHour},
+			expThr: types.SpeedThreshold{Speed: 300, Unit: types.MilesPerHour},
+			expMPH: 300,
+		},
+		{
+			req:    types.VerifyRequest{MaxSpeed: 800, SpeedUnit: "KPH"},
+			expThr: types.SpeedThreshold{Speed: 800, Unit: types.KilometersPerHour},
+			expMPH: 497.0969536,
+		},
+		{
+			req:    types.VerifyRequest{MaxSpeed: 300, SpeedUnit: "Mph"},
+			expThr: types.SpeedThreshold{Speed: 300, Unit: types.MilesPerHour},
+			expMPH: 300,
+		},
+	} {
+		thr := vs.thresholdFor(v.req)
+		if thr != v.expThr {
+			t.Errorf("(%d) expected threshold %+v, got %+v", i, v.expThr, thr)
+		}
+		if math.Abs(thr.InMilesPerHour()-v.expMPH) > 1e-6 {
+			t.Errorf("(%d) expected %f mph, got %f", i, v.expMPH, thr.InMilesPerHour())
+		}
+	}
+}
+
 type coords struct {
 	lat float64
 	lon float64
 }
 
 func TestVerify(t *testing.T) {
+	ctx := context.Background()
 	// For the test data, we include some known locations from running "dig",
 	// so we can judge the accuracy of the results.
 	// "128.148.252.151": brown.edu - Brown University, Providence, RI
@@ -128,7 +390,9 @@ func TestVerify(t *testing.T) {
 	// Distance LA-> Boca Raton: 2,326.44 mi
 	// Distance Boca Raton -> Little Rock, AR 929 Miles -> 2 hours will be suspicious
 	// NOTE: these distances are at best close to the actual distance for where these
-	// Universities are, as they are genenric city-to-city-distances.
+	// Universities are, as they are genenric city-to-city-distances.  The locations
+	// are the ones the Maxmind DB returns, served by a static geolocator so the
+	// test may run without the DB.
 	const (
 		BrownAddr    = "128.148.252.151"
 		FAUAddr      = "131.91.101.181"
@@ -147,9 +411,15 @@ func TestVerify(t *testing.T) {
 	if err != nil {
 		t.Errorf("error creating store: %v", err)
 	}
-	srv, err := New("../mmdb/GeoLite2-City.mmdb", store, l)
+	geo := NewStaticGeolocator(map[string]Location{
+		BrownAddr:    makeLoc(BrownCoords, 5),
+		FAUAddr:      makeLoc(FAUCoords, 5),
+		UCLAAddr:     makeLoc(UCLACoords, 10),
+		ArkansasAddr: makeLoc(ArkansasCoords, 5),
+	})
+	srv, err := New(geo, store, l)
 	if err != nil {
-		t.Errorf("error creating service: %v", err)
+		t.Fatalf("error creating service: %v", err)
 	}
 	defer srv.Shutdown()
 
@@ -172,21 +442,21 @@ func TestVerify(t *testing.T) {
 			seed:        []types.VerifyRequest{makeReq("Bob", FAUAddr, ago(72*time.Hour, now))},
 			payload:     makeReq("Bob", BrownAddr, now),
 			expCurr:     makeCurrGeo(BrownCoords, 5),
-			expPrev:     makeGeoEvent(FAUAddr, 16, false, FAUCoords, 5, ago(72*time.Hour, now)),
+			expPrev:     makeGeoEvent(FAUAddr, 16, 16, false, 2, FAUCoords, 5, ago(72*time.Hour, now)),
 		},
 		{
 			description: "Predecessor for user, invalid distance",
 			seed:        []types.VerifyRequest{makeReq("Bob", FAUAddr, ago(time.Hour, now))},
 			payload:     makeReq("Bob", BrownAddr, now),
 			expCurr:     makeCurrGeo(BrownCoords, 5),
-			expPrev:     makeGeoEvent(FAUAddr, 1176, true, FAUCoords, 5, ago(time.Hour, now)),
+			expPrev:     makeGeoEvent(FAUAddr, 1176, 1170, true, 95, FAUCoords, 5, ago(time.Hour, now)),
 		},
 		{
 			description: "Predecessor for user, 0 distance",
 			seed:        []types.VerifyRequest{makeReq("Jane", FAUAddr, ago(time.Hour, now))},
 			payload:     makeReq("Jane", FAUAddr, now),
 			expCurr:     makeCurrGeo(FAUCoords, 5),
-			expPrev:     makeGeoEvent(FAUAddr, 0, false, FAUCoords, 5, ago(time.Hour, now)),
+			expPrev:     makeGeoEvent(FAUAddr, 0, 0, false, 0, FAUCoords, 5, ago(time.Hour, now)),
 		},
 		{
 			description: "Predecessor for user, faulty request error",
@@ -210,14 +480,14 @@ func TestVerify(t *testing.T) {
 			seed:        []types.VerifyRequest{makeReq("Bob", FAUAddr, now)},
 			payload:     makeReq("Bob", BrownAddr, ago(72*time.Hour, now)),
 			expCurr:     makeCurrGeo(BrownCoords, 5),
-			expSucc:     makeGeoEvent(FAUAddr, 16, false, FAUCoords, 5, now),
+			expSucc:     makeGeoEvent(FAUAddr, 16, 16, false, 2, FAUCoords, 5, now),
 		},
 		{
 			description: "Successor for user, invalid distance",
 			seed:        []types.VerifyRequest{makeReq("Bob", FAUAddr, now)},
 			payload:     makeReq("Bob", BrownAddr, ago(time.Hour, now)),
 			expCurr:     makeCurrGeo(BrownCoords, 5),
-			expSucc:     makeGeoEvent(FAUAddr, 1176, true, FAUCoords, 5, now),
+			expSucc:     makeGeoEvent(FAUAddr, 1176, 1170, true, 95, FAUCoords, 5, now),
 		},
 		{
 			description: "DB with no other record for user",
@@ -239,7 +509,7 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Bob", BrownAddr, now),
 			expCurr: makeCurrGeo(BrownCoords, 5),
-			expPrev: makeGeoEvent(UCLAAddr, 36, false, UCLACoords, 10, ago(72*time.Hour, now)),
+			expPrev: makeGeoEvent(UCLAAddr, 36, 36, false, 5, UCLACoords, 10, ago(72*time.Hour, now)),
 		},
 		{
 			description: "Successor for user, invalid distance including other users",
@@ -252,7 +522,7 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Bob", FAUAddr, ago(144*time.Hour, now)),
 			expCurr: makeCurrGeo(FAUCoords, 5),
-			expSucc: makeGeoEvent(ArkansasAddr, 532, true, ArkansasCoords, 5, ago(142*time.Hour, now)),
+			expSucc: makeGeoEvent(ArkansasAddr, 532, 529, true, 79, ArkansasCoords, 5, ago(142*time.Hour, now)),
 		},
 		{
 			description: "Predecessor valid distance, successor invalid distance, including other users",
@@ -266,8 +536,8 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Angie", ArkansasAddr, ago(150*time.Hour, now)),
 			expCurr: makeCurrGeo(ArkansasCoords, 5),
-			expPrev: makeGeoEvent(BrownAddr, 26, false, BrownCoords, 5, ago(200*time.Hour, now)),
-			expSucc: makeGeoEvent(UCLAAddr, 688, true, UCLACoords, 10, ago(148*time.Hour, now)),
+			expPrev: makeGeoEvent(BrownAddr, 26, 26, false, 4, BrownCoords, 5, ago(200*time.Hour, now)),
+			expSucc: makeGeoEvent(UCLAAddr, 688, 684, true, 95, UCLACoords, 10, ago(148*time.Hour, now)),
 		},
 		{
 			description: "Predecessor valid distance, successor valid distance, including other users",
@@ -281,8 +551,8 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Angie", ArkansasAddr, ago(150*time.Hour, now)),
 			expCurr: makeCurrGeo(ArkansasCoords, 5),
-			expPrev: makeGeoEvent(ArkansasAddr, 0, false, ArkansasCoords, 5, ago(200*time.Hour, now)),
-			expSucc: makeGeoEvent(UCLAAddr, 344, false, UCLACoords, 10, ago(146*time.Hour, now)),
+			expPrev: makeGeoEvent(ArkansasAddr, 0, 0, false, 0, ArkansasCoords, 5, ago(200*time.Hour, now)),
+			expSucc: makeGeoEvent(UCLAAddr, 344, 342, false, 53, UCLACoords, 10, ago(146*time.Hour, now)),
 		},
 		{
 			description: "Predecessor invalid distance, successor valid distance, including other users",
@@ -297,8 +567,8 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Angie", ArkansasAddr, ago(150*time.Hour, now)),
 			expCurr: makeCurrGeo(ArkansasCoords, 5),
-			expPrev: makeGeoEvent(BrownAddr, 1281, true, BrownCoords, 5, ago(151*time.Hour, now)),
-			expSucc: makeGeoEvent(UCLAAddr, 344, false, UCLACoords, 10, ago(146*time.Hour, now)),
+			expPrev: makeGeoEvent(BrownAddr, 1281, 1275, true, 95, BrownCoords, 5, ago(151*time.Hour, now)),
+			expSucc: makeGeoEvent(UCLAAddr, 344, 342, false, 53, UCLACoords, 10, ago(146*time.Hour, now)),
 		},
 		{
 			description: "Record with equal timestamp should be predecessor",
@@ -313,8 +583,8 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Angie", ArkansasAddr, ago(150*time.Hour, now)),
 			expCurr: makeCurrGeo(ArkansasCoords, 5),
-			expPrev: makeGeoEvent(BrownAddr, -1, true, BrownCoords, 5, ago(150*time.Hour, now)),
-			expSucc: makeGeoEvent(UCLAAddr, 688, true, UCLACoords, 10, ago(148*time.Hour, now)),
+			expPrev: makeGeoEvent(BrownAddr, -1, -1, true, 100, BrownCoords, 5, ago(150*time.Hour, now)),
+			expSucc: makeGeoEvent(UCLAAddr, 688, 684, true, 95, UCLACoords, 10, ago(148*time.Hour, now)),
 		},
 		{
 			description: "Matching timestamp, but different user",
@@ -328,19 +598,19 @@ func TestVerify(t *testing.T) {
 			},
 			payload: makeReq("Angie", ArkansasAddr, ago(150*time.Hour, now)),
 			expCurr: makeCurrGeo(ArkansasCoords, 5),
-			expSucc: makeGeoEvent(UCLAAddr, 688, true, UCLACoords, 10, ago(148*time.Hour, now)),
+			expSucc: makeGeoEvent(UCLAAddr, 688, 684, true, 95, UCLACoords, 10, ago(148*time.Hour, now)),
 		},
 	} {
-		if err := srv.ResetStore(); err != nil {
+		if _, err := srv.ResetStore(ctx); err != nil {
 			t.Fatalf("'%s': error resetting DB: %v", v.description, err)
 		}
 
 		for _, r := range v.seed {
-			if err := srv.store.AddRecord(r); err != nil {
+			if err := srv.store.AddRecord(ctx, r); err != nil {
 				t.Errorf("'%s': error ", v.description)
 			}
 		}
-		resp, err := srv.VerifyIP(v.payload)
+		resp, err := srv.VerifyIP(ctx, v.payload)
 		if v.expErrMsg != "" {
 			if err == nil {
 				t.Errorf("'%s': expected error '%s', but got no error", v.description,
@@ -358,18 +628,1360 @@ func TestVerify(t *testing.T) {
 		expResp.CurrentGeo = v.expCurr
 		expResp.PrecedingIPAccess = v.expPrev
 		expResp.SubsequentIPAccess = v.expSucc
+		expResp.Threshold = types.SpeedThreshold{Speed: types.MaxSpeed, Unit: types.MilesPerHour}
+		for _, ge := range []*types.GeoEvent{v.expPrev, v.expSucc} {
+			if ge != nil && ge.RiskScore > expResp.RiskScore {
+				expResp.RiskScore = ge.RiskScore
+			}
+		}
+		expResp.RiskLevel = types.RiskLevelFor(expResp.RiskScore)
 		if !(reflect.DeepEqual(*resp, expResp)) {
 			t.Errorf("'%s': Expected response: %v, got: %v", v.description, expResp, resp)
 		}
 	}
 }
 
-func makeReq(username, ipaddr string, timestamp int64) types.VerifyRequest {
-	return types.VerifyRequest{
-		Username:      username,
-		UnixTimestamp: timestamp,
-		EventUUID:     uuid.New().String(),
-		IPAddress:     ipaddr,
+// TestVerifyPlaceNames checks that the place names from the geolocator
+// are passed through to the response.
+func TestVerifyPlaceNames(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	brown := Location{Latitude: 41.8244, Longitude: -71.408, AccuracyRadius: 5,
+		TimeZone: "America/New_York", CountryCode: "US", Subdivision: "Rhode Island",
+		City: "Providence"}
+	fau := Location{Latitude: 26.3796, Longitude: -80.1029, AccuracyRadius: 5,
+		TimeZone: "America/New_York", CountryCode: "US", Subdivision: "Florida",
+		City: "Boca Raton"}
+	geo := NewStaticGeolocator(map[string]Location{
+		"128.148.252.151": brown,
+		"131.91.101.181":  fau,
+	})
+	srv, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	if err := srv.store.AddRecord(ctx, makeReq("Bob", "131.91.101.181", ago(time.Hour, now))); err != nil {
+		t.Fatalf("error seeding store: %v", err)
+	}
+	resp, err := srv.VerifyIP(ctx, makeReq("Bob", "128.148.252.151", now))
+	if err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+	expCurr := types.CurrentGeoStat{Lat: brown.Latitude, Lon: brown.Longitude,
+		Radius: 5, Country: "US", Subdivision: "Rhode Island", City: "Providence",
+		TimeZone: "America/New_York"}
+	if resp.CurrentGeo != expCurr {
+		t.Errorf("expected current geo %+v, got %+v", expCurr, resp.CurrentGeo)
+	}
+	prev := resp.PrecedingIPAccess
+	if prev == nil {
+		t.Fatal("expected preceding access")
+	}
+	if prev.Country != "US" || prev.Subdivision != "Florida" ||
+		prev.City != "Boca Raton" || prev.TimeZone != "America/New_York" {
+		t.Errorf("unexpected preceding access place: %+v", *prev)
+	}
+}
+
+// TestStoredVerdict checks that the location and verdict are recorded with
+// each event, and that the recorded location of a neighbor is used rather
+// than a new lookup, so a changed geolocation database doesn't change the
+// travel.
+func TestStoredVerdict(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	brown := Location{Latitude: 41.8244, Longitude: -71.408, AccuracyRadius: 5,
+		CountryCode: "US", City: "Providence"}
+	fau := Location{Latitude: 26.3796, Longitude: -80.1029, AccuracyRadius: 5,
+		CountryCode: "US", City: "Boca Raton"}
+	denylist := iplist.New()
+	if err := denylist.Add("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(NewStaticGeolocator(map[string]Location{
+		"128.148.252.151": brown,
+		"131.91.101.181":  fau,
+	}), store, l, WithDenylist(denylist))
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	first := makeReq("Bob", "131.91.101.181", ago(time.Hour, now))
+	if _, err := srv.VerifyIP(ctx, first); err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+
+	// The database now places the first address in Providence too, but the
+	// travel is still from Boca Raton, as recorded.
+	srv.geo = NewStaticGeolocator(map[string]Location{
+		"128.148.252.151": brown,
+		"131.91.101.181":  brown,
+	})
+	second := makeReq("Bob", "128.148.252.151", now)
+	resp, err := srv.VerifyIP(ctx, second)
+	if err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+	prev := resp.PrecedingIPAccess
+	if prev == nil || prev.City != "Boca Raton" || prev.Lat != fau.Latitude || !prev.SuspiciousTravel {
+		t.Fatalf("expected suspicious travel from Boca Raton, got %+v", prev)
+	}
+	if _, err := srv.VerifyIP(ctx, makeReq("Bob", "10.1.2.3", now)); err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+
+	rows, err := store.GetAllRows(ctx)
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d (%v)", len(rows), err)
+	}
+	for _, r := range rows {
+		if r.Verdict == nil {
+			t.Fatalf("expected verdict for %s", r.IPAddress)
+		}
+	}
+	if g := rows[0].Geo; g == nil || g.City != "Boca Raton" || g.Lat != fau.Latitude {
+		t.Errorf("expected Boca Raton recorded for first event, got %+v", g)
+	}
+	if v := rows[0].Verdict; v.Preceding != nil || v.Subsequent != nil || v.RiskScore != 0 {
+		t.Errorf("unexpected verdict for first event: %+v", v)
+	}
+	second.Geo = &types.EventGeo{CurrentGeoStat: resp.CurrentGeo}
+	expected := types.EventVerdict{
+		RiskScore: resp.RiskScore,
+		RiskLevel: resp.RiskLevel,
+		Threshold: resp.Threshold,
+		Preceding: &types.TravelVerdict{IP: first.IPAddress, Timestamp: first.UnixTimestamp,
+			Speed: prev.Speed, AdjustedSpeed: prev.AdjustedSpeed, SuspiciousTravel: true,
+			RiskScore: prev.RiskScore},
+	}
+	if g := rows[1].Geo; g == nil || *g != *second.Geo {
+		t.Errorf("expected geo %+v recorded, got %+v", second.Geo, g)
+	}
+	if v := rows[1].Verdict; !reflect.DeepEqual(*v, expected) {
+		t.Errorf("expected verdict %+v, got %+v", expected, *v)
+	}
+	if g, v := rows[2].Geo, rows[2].Verdict; g != nil || !v.Blocked || v.RiskScore != 100 {
+		t.Errorf("expected blocked verdict without geo, got %+v %+v", g, v)
+	}
+
+	// A dry run records nothing.
+	dry := makeReq("Bob", "128.148.252.151", now)
+	dry.DryRun = true
+	if _, err := srv.VerifyIP(ctx, dry); err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+	if counts, err := store.Counts(ctx); err != nil || counts.Events != 3 {
+		t.Errorf("expected 3 events, got %+v (%v)", counts, err)
+	}
+}
+
+// TestSameASN checks that the threshold is relaxed for consecutive logins
+// from the same autonomous system.
+func TestSameASN(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	carrier := func(c coords, asn uint) Location {
+		loc := makeLoc(c, 5)
+		loc.ASN = asn
+		loc.ASOrg = fmt.Sprintf("AS%d Carrier", asn)
+		return loc
+	}
+	geo := NewStaticGeolocator(map[string]Location{
+		"10.0.0.1": carrier(coords{41.8244, -71.408}, 7018),
+		"10.0.0.2": carrier(coords{26.3796, -80.1029}, 7018),
+		"10.0.0.3": carrier(coords{26.3796, -80.1029}, 701),
+		"10.0.0.4": makeLoc(coords{26.3796, -80.1029}, 5),
+		"10.0.0.5": makeLoc(coords{41.8244, -71.408}, 5),
+	})
+	srv, err := New(geo, store, l, WithSameASNFactor(3))
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	for _, v := range []struct {
+		description   string
+		prevIP        string
+		curIP         string
+		gap           time.Duration
+		expSameASN    bool
+		expSuspicious bool
+	}{
+		{
+			description:   "same ASN, within relaxed threshold",
+			prevIP:        "10.0.0.2",
+			curIP:         "10.0.0.1",
+			gap:           time.Hour,
+			expSameASN:    true,
+			expSuspicious: false,
+		},
+		{
+			description:   "same ASN, exceeding relaxed threshold",
+			prevIP:        "10.0.0.2",
+			curIP:         "10.0.0.1",
+			gap:           15 * time.Minute,
+			expSameASN:    true,
+			expSuspicious: true,
+		},
+		{
+			description:   "different ASN",
+			prevIP:        "10.0.0.3",
+			curIP:         "10.0.0.1",
+			gap:           time.Hour,
+			expSuspicious: true,
+		},
+		{
+			description:   "unknown ASN",
+			prevIP:        "10.0.0.4",
+			curIP:         "10.0.0.5",
+			gap:           time.Hour,
+			expSuspicious: true,
+		},
+	} {
+		if _, err := srv.ResetStore(ctx); err != nil {
+			t.Fatalf("'%s': error resetting DB: %v", v.description, err)
+		}
+		if err := srv.store.AddRecord(ctx, makeReq("Bob", v.prevIP, ago(v.gap, now))); err != nil {
+			t.Fatalf("'%s': error seeding store: %v", v.description, err)
+		}
+		resp, err := srv.VerifyIP(ctx, makeReq("Bob", v.curIP, now))
+		if err != nil {
+			t.Fatalf("'%s': got unexpected error '%v'", v.description, err)
+		}
+		prev := resp.PrecedingIPAccess
+		if prev == nil {
+			t.Fatalf("'%s': expected preceding access", v.description)
+		}
+		if prev.SameASN != v.expSameASN {
+			t.Errorf("'%s': expected same ASN %t, got %t", v.description, v.expSameASN, prev.SameASN)
+		}
+		if prev.SuspiciousTravel != v.expSuspicious {
+			t.Errorf("'%s': expected suspicious %t, got %t", v.description,
+				v.expSuspicious, prev.SuspiciousTravel)
+		}
+	}
+}
+
+// TestAnonymity checks the anonymizer flags and reasons, using address
+// lists so the test may run offline.
+func TestAnonymity(t *testing.T) {
+	ctx := context.Background()
+	lists := map[string]string{
+		"proxy":   "198.51.100.0/24\n",
+		"hosting": "# cloud ranges\n203.0.113.0/24\n2001:db8::/32\n",
+		"tor":     "203.0.113.77\n",
+	}
+	sets := make(map[string]*iplist.Set)
+	for name, l := range lists {
+		set := iplist.New()
+		if err := set.Load(strings.NewReader(l)); err != nil {
+			t.Fatalf("error loading %s list: %v", name, err)
+		}
+		sets[name] = set
+	}
+	ac, err := NewAnonymityChecker(WithProxyList(sets["proxy"]),
+		WithHostingList(sets["hosting"]), WithTorExitList(sets["tor"]))
+	if err != nil {
+		t.Fatalf("error creating anonymity checker: %v", err)
+	}
+
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	srv, err := New(NewStaticGeolocator(nil), store, l, WithAnonymityChecker(ac))
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	for i, v := range []struct {
+		ip         string
+		expProxy   bool
+		expHosting bool
+		expTor     bool
+		expReasons []types.Reason
+	}{
+		{ip: "192.0.2.1"},
+		{
+			ip:         "198.51.100.9",
+			expProxy:   true,
+			expReasons: []types.Reason{{Code: types.ReasonAnonymousProxy, Detail: "198.51.100.0/24"}},
+		},
+		{
+			ip:         "2001:db8::5",
+			expHosting: true,
+			expReasons: []types.Reason{{Code: types.ReasonHosting, Detail: "2001:db8::/32"}},
+		},
+		{
+			ip:         "203.0.113.77",
+			expHosting: true,
+			expTor:     true,
+			expReasons: []types.Reason{
+				{Code: types.ReasonHosting, Detail: "203.0.113.0/24"},
+				{Code: types.ReasonTorExit, Detail: "203.0.113.77"},
+			},
+		},
+	} {
+		resp, err := srv.VerifyIP(ctx, makeReq("Bob", v.ip, time.Now().Unix()))
+		if err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", i, err)
+		}
+		if resp.AnonymousProxy != v.expProxy || resp.Hosting != v.expHosting ||
+			resp.TorExit != v.expTor {
+			t.Errorf("(%d) expected flags %t/%t/%t, got %t/%t/%t", i, v.expProxy,
+				v.expHosting, v.expTor, resp.AnonymousProxy, resp.Hosting, resp.TorExit)
+		}
+		if !reflect.DeepEqual(resp.Reasons, v.expReasons) {
+			t.Errorf("(%d) expected reasons %+v, got %+v", i, v.expReasons, resp.Reasons)
+		}
+	}
+}
+
+// TestTrustedNetworks checks both treatments of logins from trusted
+// networks, here a corporate VPN whose egress geolocates to Providence.
+func TestTrustedNetworks(t *testing.T) {
+	ctx := context.Background()
+	const (
+		VPNAddr = "10.8.0.1"
+		FAUAddr = "131.91.101.181"
+	)
+	now := time.Now().Unix()
+	trusted := iplist.New()
+	if err := trusted.Add("10.8.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	trustReason := []types.Reason{{Code: types.ReasonTrustedNetwork, Detail: "10.8.0.0/16"}}
+	geo := NewStaticGeolocator(map[string]Location{
+		VPNAddr: makeLoc(coords{41.8244, -71.408}, 5),
+		FAUAddr: makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+
+	for _, v := range []struct {
+		description   string
+		opts          []Option
+		payload       types.VerifyRequest
+		expPrevIP     string
+		expSuspicious bool
+		expTrusted    bool
+		expReasons    []types.Reason
+	}{
+		{
+			description:   "No trusted networks",
+			payload:       makeReq("Bob", FAUAddr, now),
+			expPrevIP:     VPNAddr,
+			expSuspicious: true,
+		},
+		{
+			description: "Exclude trusted neighbor",
+			opts:        []Option{WithTrustedNetworks(trusted, TrustExclude)},
+			payload:     makeReq("Bob", FAUAddr, now),
+			expPrevIP:   FAUAddr,
+			expReasons:  trustReason,
+		},
+		{
+			description: "Exclude trusted current event",
+			opts:        []Option{WithTrustedNetworks(trusted, TrustExclude)},
+			payload:     makeReq("Bob", VPNAddr, now),
+			expReasons:  trustReason,
+		},
+		{
+			description: "Never flag trusted neighbor",
+			opts:        []Option{WithTrustedNetworks(trusted, TrustNeverFlag)},
+			payload:     makeReq("Bob", FAUAddr, now),
+			expPrevIP:   VPNAddr,
+			expTrusted:  true,
+			expReasons:  trustReason,
+		},
+	} {
+		l := newNoopLogger()
+		store, err := store.NewSQLiteStore(":memory:", l)
+		if err != nil {
+			t.Fatalf("'%s': error creating store: %v", v.description, err)
+		}
+		srv, err := New(geo, store, l, v.opts...)
+		if err != nil {
+			t.Fatalf("'%s': error creating service: %v", v.description, err)
+		}
+		for _, r := range []types.VerifyRequest{
+			makeReq("Bob", FAUAddr, ago(2*time.Hour, now)),
+			makeReq("Bob", VPNAddr, ago(time.Hour, now)),
+		} {
+			if err := srv.store.AddRecord(ctx, r); err != nil {
+				t.Fatalf("'%s': error seeding store: %v", v.description, err)
+			}
+		}
+
+		resp, err := srv.VerifyIP(ctx, v.payload)
+		srv.Shutdown()
+		if err != nil {
+			t.Fatalf("'%s': got unexpected error '%v'", v.description, err)
+		}
+		if !reflect.DeepEqual(resp.Reasons, v.expReasons) {
+			t.Errorf("'%s': expected reasons %+v, got %+v", v.description,
+				v.expReasons, resp.Reasons)
+		}
+		prev := resp.PrecedingIPAccess
+		if v.expPrevIP == "" {
+			if prev != nil {
+				t.Errorf("'%s': expected no preceding access, got %+v", v.description, *prev)
+			}
+			continue
+		}
+		if prev == nil {
+			t.Fatalf("'%s': expected preceding access", v.description)
+		}
+		if prev.IP != v.expPrevIP || prev.SuspiciousTravel != v.expSuspicious ||
+			prev.Trusted != v.expTrusted {
+			t.Errorf("'%s': expected preceding %s (suspicious %t, trusted %t), got %+v",
+				v.description, v.expPrevIP, v.expSuspicious, v.expTrusted, *prev)
+		}
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	ctx := context.Background()
+	const (
+		FAUAddr   = "131.91.101.181"
+		BadAddr   = "203.0.113.7"
+		WorseAddr = "198.51.100.20"
+	)
+	now := time.Now().Unix()
+	file := iplist.New()
+	if err := file.Add("198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	geo := NewStaticGeolocator(map[string]Location{
+		FAUAddr: makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Shutdown()
+	srv, err := New(geo, store, l, WithDenylist(file))
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	entry, err := srv.AddDenylistEntry(ctx, types.DenylistEntry{Entry: "203.0.113.7/32", Comment: "abuse"})
+	if err != nil {
+		t.Fatalf("error adding denylist entry: %v", err)
+	}
+	if entry.Entry != BadAddr || entry.Source != types.DenylistAPI || entry.Created == 0 {
+		t.Errorf("unexpected denylist entry %+v", entry)
+	}
+
+	// A new service on the same store picks up the entry added through the API.
+	srv, err = New(geo, store, l, WithDenylist(file))
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	list, err := srv.GetDenylist(ctx)
+	if err != nil {
+		t.Fatalf("error getting denylist: %v", err)
+	}
+	expList := []types.DenylistEntry{
+		{Entry: "198.51.100.0/24", Source: types.DenylistFile},
+		{Entry: BadAddr, Comment: "abuse", Source: types.DenylistAPI, Created: entry.Created},
+	}
+	if !reflect.DeepEqual(list, expList) {
+		t.Errorf("expected denylist %+v, got %+v", expList, list)
+	}
+
+	for i, v := range []struct {
+		ip         string
+		expBlocked bool
+		expDetail  string
+	}{
+		{ip: FAUAddr},
+		{ip: BadAddr, expBlocked: true, expDetail: BadAddr},
+		{ip: WorseAddr, expBlocked: true, expDetail: "198.51.100.0/24"},
+	} {
+		resp, err := srv.VerifyIP(ctx, makeReq("Bob", v.ip, now+int64(i)))
+		if err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", i, err)
+		}
+		if resp.Blocked != v.expBlocked {
+			t.Errorf("(%d) expected blocked %t, got %t", i, v.expBlocked, resp.Blocked)
+		}
+		if !v.expBlocked {
+			continue
+		}
+		expReasons := []types.Reason{{Code: types.ReasonDenylisted, Detail: v.expDetail}}
+		if resp.RiskScore != 100 || resp.RiskLevel != types.HighRisk ||
+			!reflect.DeepEqual(resp.Reasons, expReasons) {
+			t.Errorf("(%d) unexpected blocked response %v", i, resp)
+		}
+	}
+
+	// Blocked events are still recorded.
+	rows, err := store.GetAllRows(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Errorf("expected 3 stored events, got %d", len(rows))
+	}
+
+	if err := srv.RemoveDenylistEntry(ctx, "198.51.100.0/24"); err == nil ||
+		err.Error() != "denylist entry 198.51.100.0/24 is from the denylist file" {
+		t.Errorf("unexpected error removing file entry: %v", err)
+	}
+	if err := srv.RemoveDenylistEntry(ctx, BadAddr); err != nil {
+		t.Errorf("error removing denylist entry: %v", err)
+	}
+	if _, ok := srv.RemoveDenylistEntry(ctx, BadAddr).(NotFoundError); !ok {
+		t.Error("expected not found error removing entry twice")
+	}
+	resp, err := srv.VerifyIP(ctx, makeReq("Bob", BadAddr, now+10))
+	if err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+	if resp.Blocked {
+		t.Error("expected removed entry not to block")
+	}
+}
+
+// TestDenylistReplicas checks that services sharing a store, as replicas
+// sharing a database do, see each other's denylist changes once they have
+// reloaded the denylist.
+func TestDenylistReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const BadAddr = "203.0.113.7"
+	geo := NewStaticGeolocator(map[string]Location{})
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Shutdown()
+	first, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	second, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	go second.WatchDenylist(ctx, 10*time.Millisecond)
+
+	waitFor := func(expBlocked bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, ok := second.denylisted(BadAddr); ok == expBlocked {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected blocked %t on the other service", expBlocked)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if _, err := first.AddDenylistEntry(ctx, types.DenylistEntry{Entry: BadAddr}); err != nil {
+		t.Fatalf("error adding denylist entry: %v", err)
+	}
+	if _, ok := first.denylisted(BadAddr); !ok {
+		t.Error("expected entry to block on the service that added it")
+	}
+	waitFor(true)
+
+	if err := first.RemoveDenylistEntry(ctx, BadAddr); err != nil {
+		t.Fatalf("error removing denylist entry: %v", err)
+	}
+	waitFor(false)
+}
+
+// TestVerifyBatch checks that events in a batch see each other as
+// neighbors, regardless of their order in the batch, and that a failing
+// request does not affect the others.
+func TestVerifyBatch(t *testing.T) {
+	ctx := context.Background()
+	const (
+		RIAddr  = "10.0.0.1"
+		FLAddr  = "10.0.0.2"
+		FAUAddr = "10.0.0.3"
+	)
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	geo := NewStaticGeolocator(map[string]Location{
+		RIAddr:  makeLoc(coords{41.8244, -71.408}, 5),
+		FLAddr:  makeLoc(coords{26.3796, -80.1029}, 5),
+		FAUAddr: makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+	srv, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	last := makeReq("Bob", FAUAddr, now)
+	first := makeReq("Bob", RIAddr, ago(2*time.Hour, now))
+	middle := makeReq("Bob", FLAddr, ago(time.Hour, now))
+	dup := makeReq("Bob", RIAddr, ago(3*time.Hour, now))
+	dup.EventUUID = first.EventUUID
+	alice := makeReq("Alice", RIAddr, ago(30*time.Minute, now))
+
+	results := srv.VerifyBatch(ctx, []types.VerifyRequest{last, first, dup, alice, middle})
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	if results[2].Err == nil || results[2].Response != nil {
+		t.Errorf("expected duplicate UUID to fail, got %+v", results[2])
+	}
+	for _, v := range []struct {
+		index   int
+		expPrev string
+		expNext string
+	}{
+		{index: 0, expPrev: FLAddr},
+		{index: 1, expNext: FLAddr},
+		{index: 3},
+		{index: 4, expPrev: RIAddr, expNext: FAUAddr},
+	} {
+		res := results[v.index]
+		if res.Err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", v.index, res.Err)
+		}
+		var prevIP, nextIP string
+		if res.Response.PrecedingIPAccess != nil {
+			prevIP = res.Response.PrecedingIPAccess.IP
+		}
+		if res.Response.SubsequentIPAccess != nil {
+			nextIP = res.Response.SubsequentIPAccess.IP
+		}
+		if prevIP != v.expPrev || nextIP != v.expNext {
+			t.Errorf("(%d) expected neighbors (%s, %s), got (%s, %s)", v.index,
+				v.expPrev, v.expNext, prevIP, nextIP)
+		}
+	}
+	if !results[4].Response.PrecedingIPAccess.SuspiciousTravel {
+		t.Error("expected travel from Rhode Island to be suspicious")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	const (
+		RIAddr = "10.0.0.1"
+		FLAddr = "10.0.0.2"
+	)
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	geo := NewStaticGeolocator(map[string]Location{
+		RIAddr: makeLoc(coords{41.8244, -71.408}, 5),
+		FLAddr: makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+	srv, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	prev := makeReq("Bob", RIAddr, ago(time.Hour, now))
+	if _, err := srv.VerifyIP(ctx, prev); err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+
+	// A dry run sees the stored event, and may be repeated, since nothing
+	// is recorded.
+	req := makeReq("Bob", FLAddr, now)
+	req.DryRun = true
+	for i := 0; i < 2; i++ {
+		resp, err := srv.VerifyIP(ctx, req)
+		if err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", i, err)
+		}
+		if !resp.DryRun {
+			t.Errorf("(%d) expected dry run response", i)
+		}
+		if resp.PrecedingIPAccess == nil || resp.PrecedingIPAccess.IP != RIAddr ||
+			!resp.PrecedingIPAccess.SuspiciousTravel {
+			t.Errorf("(%d) expected suspicious preceding access from %s, got %v", i, RIAddr, resp)
+		}
+	}
+	rows, err := store.GetAllRows(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].EventUUID != prev.EventUUID {
+		t.Errorf("expected only the original event to be stored, got %+v", rows)
+	}
+
+	// Re-evaluating a stored event doesn't compare it with itself.
+	prev.DryRun = true
+	resp, err := srv.VerifyIP(ctx, prev)
+	if err != nil {
+		t.Fatalf("got unexpected error '%v'", err)
+	}
+	if resp.PrecedingIPAccess != nil || resp.SubsequentIPAccess != nil {
+		t.Errorf("expected no neighbors, got %v", resp)
+	}
+}
+
+// TestFailedVerify checks that a request that fails after it was added to
+// the store is removed again, so that it may be retried with the same UUID.
+func TestFailedVerify(t *testing.T) {
+	ctx := context.Background()
+	const (
+		RIAddr = "10.0.0.1"
+		FLAddr = "10.0.0.2"
+	)
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	sqlStore, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	fs := &priorNextFailer{Store: sqlStore, err: context.DeadlineExceeded}
+	geo := NewStaticGeolocator(map[string]Location{
+		RIAddr: makeLoc(coords{41.8244, -71.408}, 5),
+		FLAddr: makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+	srv, err := New(geo, fs, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	req := makeReq("Bob", RIAddr, ago(time.Hour, now))
+	batchReq := makeReq("Bob", FLAddr, now)
+	if _, err := srv.VerifyIP(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got '%v'", err)
+	}
+	results := srv.VerifyBatch(ctx, []types.VerifyRequest{batchReq})
+	if !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got '%v'", results[0].Err)
+	}
+	rows, err := sqlStore.GetAllRows(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("expected failed requests to be removed, got %+v", rows)
+	}
+
+	// Retrying with the same UUIDs succeeds.
+	fs.err = nil
+	if _, err := srv.VerifyIP(ctx, req); err != nil {
+		t.Fatalf("got unexpected error retrying '%v'", err)
+	}
+	results = srv.VerifyBatch(ctx, []types.VerifyRequest{batchReq})
+	if results[0].Err != nil {
+		t.Fatalf("got unexpected error retrying batch '%v'", results[0].Err)
+	}
+	if prev := results[0].Response.PrecedingIPAccess; prev == nil || prev.IP != RIAddr {
+		t.Errorf("expected preceding access from %s, got %+v", RIAddr, prev)
+	}
+}
+
+// priorNextFailer fails the lookups of prior and next events with err, if
+// it is set.
+type priorNextFailer struct {
+	store.Store
+	err error
+}
+
+func (pf *priorNextFailer) GetPriorNext(ctx context.Context, username string, uuid string,
+	timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error) {
+	if pf.err != nil {
+		return nil, nil, pf.err
+	}
+	return pf.Store.GetPriorNext(ctx, username, uuid, timestamp)
+}
+
+func (pf *priorNextFailer) GetPriorNextMatching(ctx context.Context, username string,
+	uuid string, timestamp int64, match func(types.VerifyRequest) bool) (*types.VerifyRequest,
+	*types.VerifyRequest, error) {
+	if pf.err != nil {
+		return nil, nil, pf.err
+	}
+	return pf.Store.GetPriorNextMatching(ctx, username, uuid, timestamp, match)
+}
+
+func TestGetUserEvents(t *testing.T) {
+	ctx := context.Background()
+	const (
+		RIAddr  = "10.0.0.1"
+		FLAddr  = "10.0.0.2"
+		UCLAddr = "10.0.0.3"
+	)
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	sqs, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	store := &priorNextCounter{Store: sqs}
+	geo := NewStaticGeolocator(map[string]Location{
+		RIAddr:  makeLoc(coords{41.8244, -71.408}, 5),
+		FLAddr:  makeLoc(coords{26.3796, -80.1029}, 5),
+		UCLAddr: makeLoc(coords{34.0648, -118.4414}, 10),
+	})
+	srv, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	events := []types.VerifyRequest{
+		makeReq("Bob", RIAddr, ago(48*time.Hour, now)),
+		makeReq("Bob", FLAddr, ago(47*time.Hour, now)),
+		makeReq("Bob", UCLAddr, ago(24*time.Hour, now)),
+		makeReq("Bob", RIAddr, now),
+		makeReq("Alice", FLAddr, ago(time.Hour, now)),
+		makeReq("Dave", RIAddr, ago(2*time.Hour, now)),
+		makeReq("Dave", FLAddr, ago(2*time.Hour, now)),
+	}
+	events[2].Client = "billing"
+	for _, e := range events {
+		if err := store.AddRecord(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, v := range []struct {
+		username   string
+		query      types.EventQuery
+		expTotal   int
+		expEvents  []int // indexes in events
+		expPrevIPs []string
+	}{
+		{
+			username:   "Bob",
+			query:      types.EventQuery{Limit: 10, Order: types.Descending},
+			expTotal:   4,
+			expEvents:  []int{3, 2, 1, 0},
+			expPrevIPs: []string{UCLAddr, FLAddr, RIAddr, ""},
+		},
+		{
+			username:   "Bob",
+			query:      types.EventQuery{Limit: 2, Offset: 1, Order: types.Ascending},
+			expTotal:   4,
+			expEvents:  []int{1, 2},
+			expPrevIPs: []string{RIAddr, FLAddr},
+		},
+		{
+			username:   "Bob",
+			query:      types.EventQuery{Limit: 2, Order: types.Descending},
+			expTotal:   4,
+			expEvents:  []int{3, 2},
+			expPrevIPs: []string{UCLAddr, FLAddr},
+		},
+		{
+			username:   "Bob",
+			query:      types.EventQuery{Limit: 2, Offset: 2, Order: types.Descending},
+			expTotal:   4,
+			expEvents:  []int{1, 0},
+			expPrevIPs: []string{RIAddr, ""},
+		},
+		{
+			username:   "Bob",
+			query:      types.EventQuery{Limit: 2, Offset: 3, Order: types.Ascending},
+			expTotal:   4,
+			expEvents:  []int{3},
+			expPrevIPs: []string{UCLAddr},
+		},
+		{
+			// The predecessor is found even outside the time range.
+			username:   "Bob",
+			query:      types.EventQuery{From: ago(30*time.Hour, now), Limit: 10, Order: types.Ascending},
+			expTotal:   2,
+			expEvents:  []int{2, 3},
+			expPrevIPs: []string{FLAddr, UCLAddr},
+		},
+		{
+			username: "Bob",
+			query:    types.EventQuery{To: ago(72*time.Hour, now), Limit: 10},
+		},
+		{
+			username: "Carol",
+			query:    types.EventQuery{Limit: 10},
+		},
+		{
+			// Events at the same time are in the order they were stored,
+			// whichever page they are on.
+			username:   "Dave",
+			query:      types.EventQuery{Limit: 10, Order: types.Ascending},
+			expTotal:   2,
+			expEvents:  []int{5, 6},
+			expPrevIPs: []string{"", RIAddr},
+		},
+		{
+			username:   "Dave",
+			query:      types.EventQuery{Limit: 1, Order: types.Ascending},
+			expTotal:   2,
+			expEvents:  []int{5},
+			expPrevIPs: []string{""},
+		},
+		{
+			username:   "Dave",
+			query:      types.EventQuery{Limit: 1, Offset: 1, Order: types.Ascending},
+			expTotal:   2,
+			expEvents:  []int{6},
+			expPrevIPs: []string{RIAddr},
+		},
+		{
+			username:   "Dave",
+			query:      types.EventQuery{Limit: 1, Order: types.Descending},
+			expTotal:   2,
+			expEvents:  []int{6},
+			expPrevIPs: []string{RIAddr},
+		},
+		{
+			username:   "Dave",
+			query:      types.EventQuery{Limit: 1, Offset: 1, Order: types.Descending},
+			expTotal:   2,
+			expEvents:  []int{5},
+			expPrevIPs: []string{""},
+		},
+	} {
+		store.calls = 0
+		resp, err := srv.GetUserEvents(ctx, v.username, v.query)
+		if err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", i, err)
+		}
+		if store.calls > 1 {
+			t.Errorf("(%d) expected at most one prior event lookup, got %d", i, store.calls)
+		}
+		if resp.Total != v.expTotal || len(resp.Events) != len(v.expEvents) {
+			t.Fatalf("(%d) expected %d of %d events, got %d of %d", i, len(v.expEvents),
+				v.expTotal, len(resp.Events), resp.Total)
+		}
+		for j, ev := range resp.Events {
+			exp := events[v.expEvents[j]]
+			if ev.EventUUID != exp.EventUUID || ev.IP != exp.IPAddress ||
+				ev.Timestamp != exp.UnixTimestamp || ev.Client != exp.Client {
+				t.Errorf("(%d) expected event %d to be %+v, got %+v", i, j, exp, ev)
+			}
+			loc := geo.locs[ev.IP]
+			if ev.Geo.Lat != loc.Latitude || ev.Geo.Lon != loc.Longitude ||
+				ev.Geo.Radius != loc.AccuracyRadius {
+				t.Errorf("(%d) unexpected geo %+v for event %d", i, ev.Geo, j)
+			}
+			var prevIP string
+			if ev.FromPrevious != nil {
+				prevIP = ev.FromPrevious.IP
+			}
+			if prevIP != v.expPrevIPs[j] {
+				t.Errorf("(%d) expected event %d previous IP '%s', got '%s'", i, j,
+					v.expPrevIPs[j], prevIP)
+			}
+		}
+	}
+
+	// Travel from Rhode Island to Florida in an hour is suspicious.
+	resp, err := srv.GetUserEvents(ctx, "Bob", types.EventQuery{Limit: 1, Offset: 1,
+		Order: types.Ascending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ge := resp.Events[0].FromPrevious; ge == nil || !ge.SuspiciousTravel ||
+		ge.RiskLevel != types.HighRisk {
+		t.Errorf("expected suspicious travel, got %+v", ge)
+	}
+}
+
+// priorNextCounter counts the lookups of prior and next events, to check
+// the travel between listed events is found without one per event.
+type priorNextCounter struct {
+	store.Store
+	calls int
+}
+
+func (pc *priorNextCounter) GetPriorNext(ctx context.Context, username string, uuid string,
+	timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error) {
+	pc.calls++
+	return pc.Store.GetPriorNext(ctx, username, uuid, timestamp)
+}
+
+func (pc *priorNextCounter) GetPriorNextMatching(ctx context.Context, username string,
+	uuid string, timestamp int64, match func(types.VerifyRequest) bool) (*types.VerifyRequest,
+	*types.VerifyRequest, error) {
+	pc.calls++
+	return pc.Store.GetPriorNextMatching(ctx, username, uuid, timestamp, match)
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	srv, err := New(NewStaticGeolocator(nil), store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+
+	bob1 := makeReq("Bob", "10.0.0.1", ago(2*time.Hour, now))
+	bob2 := makeReq("Bob", "10.0.0.2", ago(time.Hour, now))
+	alice := makeReq("Alice", "10.0.0.1", now)
+	for _, r := range []types.VerifyRequest{bob1, bob2, alice} {
+		if err := store.AddRecord(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Events may only be deleted by their own user.
+	if _, err := srv.DeleteEvent(ctx, "Bob", alice.EventUUID); err == nil ||
+		err.Error() != fmt.Sprintf("event %s not found for user Bob", alice.EventUUID) {
+		t.Errorf("unexpected error deleting another user's event: %v", err)
+	}
+	if n, err := srv.DeleteEvent(ctx, "Bob", bob1.EventUUID); err != nil || n != 1 {
+		t.Errorf("expected 1 event deleted, got (%d, %v)", n, err)
+	}
+	if n, err := srv.DeleteUser(ctx, "Bob"); err != nil || n != 1 {
+		t.Errorf("expected 1 event deleted, got (%d, %v)", n, err)
+	}
+	if _, err := srv.DeleteUser(ctx, "Bob"); err == nil {
+		t.Error("expected not found error deleting user twice")
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	rows, err := store.GetAllRows(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].EventUUID != alice.EventUUID {
+		t.Errorf("expected only Alice's event to remain, got %+v", rows)
+	}
+	if n, err := srv.ResetStore(ctx); err != nil || n != 1 {
+		t.Errorf("expected reset to delete 1 event, got (%d, %v)", n, err)
+	}
+
+	audit, err := store.GetAuditLog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expAudit := []types.AuditEntry{
+		{Action: types.AuditDeleteEvent, Username: "Bob", EventUUID: alice.EventUUID},
+		{Action: types.AuditDeleteEvent, Username: "Bob", EventUUID: bob1.EventUUID, Deleted: 1},
+		{Action: types.AuditDeleteUser, Username: "Bob", Deleted: 1},
+		{Action: types.AuditDeleteUser, Username: "Bob"},
+		{Action: types.AuditReset, Deleted: 1},
+	}
+	if len(audit) != len(expAudit) {
+		t.Fatalf("expected %d audit entries, got %+v", len(expAudit), audit)
+	}
+	for i, a := range audit {
+		if a.Created < now {
+			t.Errorf("(%d) unexpected audit time %d", i, a.Created)
+		}
+		a.Created = 0
+		if a != expAudit[i] {
+			t.Errorf("(%d) expected audit entry %+v, got %+v", i, expAudit[i], a)
+		}
+	}
+}
+
+func TestPruner(t *testing.T) {
+	ctx := context.Background()
+	const day = 24 * time.Hour
+	now := time.Now().Unix()
+	for _, v := range []struct {
+		description string
+		opts        []PrunerOption
+		expDeleted  int64
+		expKept     map[string]int
+	}{
+		{
+			description: "no policy",
+			expKept:     map[string]int{"Bob": 6, "Alice": 2},
+		},
+		{
+			description: "max age",
+			opts:        []PrunerOption{WithMaxAge(60 * time.Hour)},
+			expDeleted:  4,
+			expKept:     map[string]int{"Bob": 3, "Alice": 1},
+		},
+		{
+			description: "max events per user",
+			opts:        []PrunerOption{WithMaxEventsPerUser(2)},
+			expDeleted:  4,
+			expKept:     map[string]int{"Bob": 2, "Alice": 2},
+		},
+		{
+			description: "both",
+			opts:        []PrunerOption{WithMaxAge(60 * time.Hour), WithMaxEventsPerUser(2)},
+			expDeleted:  5,
+			expKept:     map[string]int{"Bob": 2, "Alice": 1},
+		},
+	} {
+		l := newNoopLogger()
+		store, err := store.NewSQLiteStore(":memory:", l)
+		if err != nil {
+			t.Fatalf("'%s': error creating store: %v", v.description, err)
+		}
+		for i := 0; i < 6; i++ {
+			if err := store.AddRecord(ctx, makeReq("Bob", "10.0.0.1", ago(time.Duration(i)*day, now))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, d := range []time.Duration{time.Hour, 10 * day} {
+			if err := store.AddRecord(ctx, makeReq("Alice", "10.0.0.1", ago(d, now))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A small batch size makes the pruner take several batches.
+		p := NewPruner(store, l, append(v.opts, WithPruneBatchSize(2))...)
+		n, err := p.Prune(ctx)
+		if err != nil {
+			t.Fatalf("'%s': error pruning: %v", v.description, err)
+		}
+		if n != v.expDeleted {
+			t.Errorf("'%s': expected %d deleted, got %d", v.description, v.expDeleted, n)
+		}
+
+		// The newest events are kept.
+		rows, err := store.GetAllRows(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := make(map[string]int)
+		for _, r := range rows {
+			kept[r.Username]++
+			if r.Username == "Bob" && r.UnixTimestamp < ago(time.Duration(v.expKept["Bob"])*day, now) {
+				t.Errorf("'%s': expected newer events to be kept, got %+v", v.description, r)
+			}
+		}
+		if !reflect.DeepEqual(kept, v.expKept) {
+			t.Errorf("'%s': expected %v kept, got %v", v.description, v.expKept, kept)
+		}
+
+		if n, err := p.Prune(ctx); err != nil || n != 0 {
+			t.Errorf("'%s': expected nothing left to prune, got (%d, %v)", v.description, n, err)
+		}
+		stats := p.Stats()
+		if stats.Runs != 2 || stats.Deleted != v.expDeleted || stats.LastDeleted != 0 ||
+			stats.LastRun < now {
+			t.Errorf("'%s': unexpected stats %+v", v.description, stats)
+		}
+		store.Shutdown()
+	}
+}
+
+func TestPrunerStartStop(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Shutdown()
+	if err := store.AddRecord(ctx, makeReq("Bob", "10.0.0.1", ago(48*time.Hour, now))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first prune runs right away, without waiting for the interval.
+	p := NewPruner(store, l, WithMaxAge(24*time.Hour))
+	p.Start(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().Runs == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Stop()
+	if stats := p.Stats(); stats.Runs != 1 || stats.Deleted != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+	const canary = "10.0.0.1"
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	geo := NewStaticGeolocator(map[string]Location{
+		canary: makeLoc(coords{41.8244, -71.408}, 5),
+	})
+	srv, err := New(geo, store, l, WithCanaryIP(canary))
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	for _, req := range []types.VerifyRequest{
+		makeReq("Bob", canary, ago(time.Hour, now)),
+		makeReq("Alice", canary, now),
+	} {
+		if _, err := srv.VerifyIP(ctx, req); err != nil {
+			t.Fatalf("got unexpected error '%v'", err)
+		}
+	}
+	if _, err := srv.AddDenylistEntry(ctx, types.DenylistEntry{Entry: "203.0.113.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := types.ReadyResponse{
+		Status: types.Ready,
+		Store: types.StoreReadiness{
+			Status:      types.Ready,
+			StoreCounts: types.StoreCounts{Events: 2, Denylist: 1},
+		},
+		GeoDB: types.GeoDBReadiness{
+			Status:    types.Ready,
+			CanaryIP:  canary,
+			GeoDBInfo: types.GeoDBInfo{Type: "static"},
+		},
+	}
+	// The rows are counted in the background, so the first check has no
+	// counts, and a later one has those from the refresh it started.
+	resp := srv.Ready(ctx)
+	if resp.Store.CountedAt != "" || resp.Store.StoreCounts != (types.StoreCounts{}) {
+		t.Errorf("expected no counts yet, got %+v", resp.Store)
+	}
+	for i := 0; i < 100 && resp.Store.CountedAt == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		resp = srv.Ready(ctx)
+	}
+	if resp.Store.CountedAt == "" {
+		t.Fatal("expected the rows to have been counted")
+	}
+	resp.Store.CountedAt = ""
+	if !reflect.DeepEqual(resp, exp) {
+		t.Errorf("expected %+v, got %+v", exp, resp)
+	}
+
+	// The counts are reused until they are stale.
+	if _, err := srv.AddDenylistEntry(ctx, types.DenylistEntry{Entry: "203.0.113.8"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := srv.Ready(ctx); resp.Store.Denylist != 1 {
+		t.Errorf("expected cached denylist count 1, got %d", resp.Store.Denylist)
+	}
+
+	// A canary address that isn't in the database degrades the service.
+	srv.canaryIP = "10.0.0.2"
+	resp = srv.Ready(ctx)
+	if resp.Status != types.Degraded || resp.Store.Status != types.Ready ||
+		resp.GeoDB.Status != types.Degraded ||
+		resp.GeoDB.Error != "canary address 10.0.0.2 not found" {
+		t.Errorf("expected degraded geo DB, got %+v", resp)
+	}
+
+	// As does a store that can't be queried.
+	srv.canaryIP = canary
+	srv.Shutdown()
+	resp = srv.Ready(ctx)
+	if resp.Status != types.Degraded || resp.Store.Status != types.Degraded ||
+		resp.Store.Error == "" || resp.GeoDB.Status != types.Ready {
+		t.Errorf("expected degraded store, got %+v", resp)
+	}
+}
+
+func TestVerifyMetrics(t *testing.T) {
+	ctx := context.Background()
+	const (
+		RIAddr   = "10.0.0.1"
+		FLAddr   = "10.0.0.2"
+		DenyAddr = "10.0.0.9"
+	)
+	now := time.Now().Unix()
+	l := newNoopLogger()
+	store, err := store.NewSQLiteStore(":memory:", l)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	geo := NewStaticGeolocator(map[string]Location{
+		RIAddr: makeLoc(coords{41.8244, -71.408}, 5),
+		FLAddr: makeLoc(coords{26.3796, -80.1029}, 5),
+	})
+	srv, err := New(geo, store, l)
+	if err != nil {
+		t.Fatalf("error creating service: %v", err)
+	}
+	defer srv.Shutdown()
+	if _, err := srv.AddDenylistEntry(ctx, types.DenylistEntry{Entry: DenyAddr}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters are global, so only the changes are checked.
+	outcomes := []string{outcomeBlocked, outcomeSuspiciousPreceding,
+		outcomeSuspiciousSubsequent, outcomeZeroTime}
+	before := make(map[string]float64)
+	for _, o := range outcomes {
+		before[o] = testutil.ToFloat64(verifyOutcomes.WithLabelValues(o))
+	}
+	verified := testutil.ToFloat64(verifications)
+
+	for i, req := range []types.VerifyRequest{
+		makeReq("Bob", RIAddr, ago(time.Hour, now)),   // no neighbors
+		makeReq("Bob", FLAddr, now),                   // suspicious preceding
+		makeReq("Bob", FLAddr, ago(2*time.Hour, now)), // suspicious subsequent
+		makeReq("Bob", RIAddr, now),                   // zero time, and suspicious preceding
+		makeReq("Bob", DenyAddr, now),                 // blocked
+	} {
+		if _, err := srv.VerifyIP(ctx, req); err != nil {
+			t.Fatalf("(%d) got unexpected error '%v'", i, err)
+		}
+	}
+
+	if n := testutil.ToFloat64(verifications) - verified; n != 5 {
+		t.Errorf("expected 5 verifications, got %v", n)
+	}
+	for o, exp := range map[string]float64{
+		outcomeBlocked:              1,
+		outcomeSuspiciousPreceding:  2,
+		outcomeSuspiciousSubsequent: 1,
+		outcomeZeroTime:             1,
+	} {
+		if n := testutil.ToFloat64(verifyOutcomes.WithLabelValues(o)) - before[o]; n != exp {
+			t.Errorf("expected %v %s outcomes, got %v", exp, o, n)
+		}
+	}
+}
+
+func makeReq(username, ipaddr string, timestamp int64) types.VerifyRequest {
+	return types.VerifyRequest{
+		Username:      username,
+		UnixTimestamp: timestamp,
+		EventUUID:     uuid.New().String(),
+		IPAddress:     ipaddr,
+	}
+}
+
+func makeLoc(c coords, radius uint16) Location {
+	return Location{
+		Latitude:       c.lat,
+		Longitude:      c.lon,
+		AccuracyRadius: radius,
 	}
 }
 
@@ -381,12 +1993,15 @@ func makeCurrGeo(c coords, radius uint16) types.CurrentGeoStat {
 	}
 }
 
-func makeGeoEvent(ip string, speed int64, suspicious bool,
+func makeGeoEvent(ip string, speed, adjSpeed int64, suspicious bool, score int,
 	c coords, radius uint16, timestamp int64) *types.GeoEvent {
 	return &types.GeoEvent{
 		IP:               ip,
 		Speed:            speed,
+		AdjustedSpeed:    adjSpeed,
 		SuspiciousTravel: suspicious,
+		RiskScore:        score,
+		RiskLevel:        types.RiskLevelFor(score),
 		Lat:              c.lat,
 		Lon:              c.lon,
 		Radius:           radius,
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gdotgordon/ipverify/types"
+	"github.com/pkg/errors"
+)
+
+// GetUserEvents returns a page of a user's stored events, each with its
+// location and the travel from the user's preceding event.  The preceding
+// event is the one before it in time, with ties broken by the order the
+// events were stored, so it may be outside the page or time range.  The
+// travel is judged against the default threshold, since overrides in the
+// original requests are not stored.  The location is the one recorded with
+// the event, if any, and the verdict returned at the time is included where
+// it was recorded.
+func (vs *VerifyService) GetUserEvents(ctx context.Context, username string,
+	query types.EventQuery) (*types.UserEventsResponse, error) {
+
+	// Fetch one more event on the earlier side of the page, so that the
+	// preceding event of each one on the page is at hand.
+	fetch := query
+	descending := query.Order == types.Descending
+	if descending || query.Offset > 0 {
+		fetch.Limit++
+		if !descending {
+			fetch.Offset--
+		}
+	}
+	reqs, total, err := vs.store.GetUserEvents(ctx, username, fetch)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	// Put the events in time order, with the extra one, if any, first.
+	page := make([]types.VerifyRequest, len(reqs))
+	for i, req := range reqs {
+		if descending {
+			i = len(reqs) - 1 - i
+		}
+		page[i] = req
+	}
+	var before *types.VerifyRequest
+	if len(page) > 0 && (!descending && fetch.Offset < query.Offset ||
+		descending && len(page) == fetch.Limit) {
+		before = &page[0]
+		page = page[1:]
+	}
+
+	// Without the extra event, the first event on the page is the first in
+	// the time range, so its predecessor, if any, is outside the range and
+	// is looked up.  Any other event at the same time was stored after it,
+	// so is skipped.
+	if before == nil && len(page) > 0 {
+		first := page[0]
+		before, _, err = vs.store.GetPriorNextMatching(ctx, username, first.EventUUID,
+			first.UnixTimestamp, func(req types.VerifyRequest) bool {
+				return req.UnixTimestamp < first.UnixTimestamp
+			})
+		if err != nil {
+			return nil, errors.Wrap(contextError(ctx, err), "getting prior record")
+		}
+	}
+
+	resp := types.UserEventsResponse{
+		Username: username,
+		Total:    total,
+		Limit:    query.Limit,
+		Offset:   query.Offset,
+		Events:   make([]types.UserEvent, len(page)),
+	}
+	prev := before
+	for i := range page {
+		req := &page[i]
+		loc, err := vs.eventLocation(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "IP lookup")
+		}
+		ev := types.UserEvent{
+			EventUUID: req.EventUUID,
+			IP:        req.IPAddress,
+			Timestamp: req.UnixTimestamp,
+			Client:    req.Client,
+			Geo:       currentGeo(loc),
+			Verdict:   req.Verdict,
+		}
+		if req.Geo != nil {
+			ev.GeoBuild = req.Geo.BuildEpoch
+		}
+		if prev != nil {
+			var scratch types.VerifyResponse
+			ev.FromPrevious, err = vs.geoEventFromRequest(loc, req, prev,
+				vs.maxSpeed, &scratch)
+			if err != nil {
+				return nil, errors.Wrap(err, "calculating travel")
+			}
+		}
+		prev = req
+
+		// The response is in the order of the query.
+		j := i
+		if descending {
+			j = len(page) - 1 - i
+		}
+		resp.Events[j] = ev
+	}
+	return &resp, nil
+}
+
+// DeleteUser deletes all of a user's events, returning the number deleted.
+func (vs *VerifyService) DeleteUser(ctx context.Context, username string) (int64, error) {
+	n, err := vs.store.DeleteUser(ctx, username)
+	if err != nil {
+		return 0, storeError(ctx, err)
+	}
+	if n == 0 {
+		return 0, NotFoundError(fmt.Sprintf("no events found for user %s", username))
+	}
+	return n, nil
+}
+
+// DeleteEvent deletes one of a user's events.
+func (vs *VerifyService) DeleteEvent(ctx context.Context, username string,
+	uuid string) (int64, error) {
+	n, err := vs.store.DeleteEvent(ctx, username, uuid)
+	if err != nil {
+		return 0, storeError(ctx, err)
+	}
+	if n == 0 {
+		return 0, NotFoundError(fmt.Sprintf("event %s not found for user %s", uuid, username))
+	}
+	return n, nil
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/gdotgordon/ipverify/types"
+)
+
+// eventColumns are the columns of an event in the SQL stores, in the order
+// scanEvent reads them.
+const eventColumns = `Uuid, Username, Ipaddr, Unix, Client, Lat, Lon, Radius, Country,
+	Subdivision, City, TimeZone, ASN, ASOrg, GeoBuild, Verdict`
+
+// geoColumns are the columns of an event's location, in the order geoArgs
+// returns their values.
+const geoColumns = `Lat, Lon, Radius, Country, Subdivision, City, TimeZone, ASN, ASOrg,
+	GeoBuild`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEvent reads an event from the columns in eventColumns.  The location
+// and verdict columns are NULL for events recorded before they were kept,
+// and the location for denylisted events.
+func scanEvent(row rowScanner) (types.VerifyRequest, error) {
+	var item types.VerifyRequest
+	var lat, lon sql.NullFloat64
+	var radius, asn, build sql.NullInt64
+	var country, subdivision, city, timeZone, asOrg, verdict sql.NullString
+	if err := row.Scan(&item.EventUUID, &item.Username, &item.IPAddress,
+		&item.UnixTimestamp, &item.Client, &lat, &lon, &radius, &country, &subdivision,
+		&city, &timeZone, &asn, &asOrg, &build, &verdict); err != nil {
+		return item, err
+	}
+	if lat.Valid {
+		item.Geo = &types.EventGeo{
+			CurrentGeoStat: types.CurrentGeoStat{
+				Lat:         lat.Float64,
+				Lon:         lon.Float64,
+				Radius:      uint16(radius.Int64),
+				Country:     country.String,
+				Subdivision: subdivision.String,
+				City:        city.String,
+				TimeZone:    timeZone.String,
+				ASN:         uint(asn.Int64),
+				ASOrg:       asOrg.String,
+			},
+			BuildEpoch: uint(build.Int64),
+		}
+	}
+	if verdict.Valid {
+		item.Verdict = new(types.EventVerdict)
+		if err := json.Unmarshal([]byte(verdict.String), item.Verdict); err != nil {
+			return item, err
+		}
+	}
+	return item, nil
+}
+
+// geoArgs gets the values of the columns in geoColumns, which are all NULL
+// if there is no location.
+func geoArgs(geo *types.EventGeo) []interface{} {
+	if geo == nil {
+		return make([]interface{}, 10)
+	}
+	return []interface{}{geo.Lat, geo.Lon, int64(geo.Radius), geo.Country, geo.Subdivision,
+		geo.City, geo.TimeZone, int64(geo.ASN), geo.ASOrg, int64(geo.BuildEpoch)}
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"sync"
+)
+
+// rwLock is a readers-writer lock whose callers can give up waiting for it
+// when their context is done, which sync.RWMutex doesn't allow.  As with
+// sync.RWMutex, a waiting writer blocks new readers, so a steady stream of
+// reads can't starve the writers.  The zero value is an unlocked rwLock.
+type rwLock struct {
+	mu      sync.Mutex
+	readers int
+	writing bool
+	waiting int // writers waiting for the lock
+	changed chan struct{}
+}
+
+// Lock acquires the lock for writing, unless the context is done first.
+func (l *rwLock) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	l.waiting++
+	for l.writing || l.readers > 0 {
+		if err := l.wait(ctx); err != nil {
+			l.waiting--
+
+			// Readers may have been waiting only because of this writer.
+			l.broadcast()
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.waiting--
+	l.writing = true
+	l.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the lock for writing.
+func (l *rwLock) Unlock() {
+	l.mu.Lock()
+	l.writing = false
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+// RLock acquires the lock for reading, unless the context is done first.
+func (l *rwLock) RLock(ctx context.Context) error {
+	l.mu.Lock()
+	for l.writing || l.waiting > 0 {
+		if err := l.wait(ctx); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.readers++
+	l.mu.Unlock()
+	return nil
+}
+
+// RUnlock releases the lock for reading.
+func (l *rwLock) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		l.broadcast()
+	}
+	l.mu.Unlock()
+}
+
+// wait releases the mutex until the state of the lock changes or the
+// context is done, and then reacquires it.  It must be called with the
+// mutex held.
+func (l *rwLock) wait(ctx context.Context) error {
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	changed := l.changed
+	l.mu.Unlock()
+	select {
+	case <-changed:
+		l.mu.Lock()
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		return ctx.Err()
+	}
+}
+
+// broadcast wakes up all the waiters.  It must be called with the mutex
+// held.
+func (l *rwLock) broadcast() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/ipverify/types"
+	"go.uber.org/zap"
+)
+
+func TestRWLock(t *testing.T) {
+	var l rwLock
+	ctx := context.Background()
+
+	// Readers share the lock.
+	if err := l.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer gives up at its deadline, after which readers aren't held
+	// up by it any longer.
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.Lock(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if err := l.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiting writer gets the lock once the readers are done, and new
+	// readers wait for it.
+	locked := make(chan struct{})
+	go func() {
+		if err := l.Lock(ctx); err != nil {
+			t.Error(err)
+		}
+		close(locked)
+	}()
+	for waiting := 0; waiting == 0; {
+		time.Sleep(time.Millisecond)
+		l.mu.Lock()
+		waiting = l.waiting
+		l.mu.Unlock()
+	}
+	tctx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.RLock(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		l.RUnlock()
+	}
+	<-locked
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.RLock(cctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	l.Unlock()
+	if err := l.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+}
+
+func TestStoreContext(t *testing.T) {
+	sqs, err := NewSQLiteStore(":memory:", zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqs.Shutdown()
+	ctx := context.Background()
+	req := types.VerifyRequest{Username: "Bob", EventUUID: "85ad929a-db03-4bf4-9541-8f728fa12e42",
+		IPAddress: "10.0.0.1", UnixTimestamp: 1514764800}
+
+	// A store call waiting for the lock gives up at the deadline.
+	if err := sqs.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := sqs.AddRecord(tctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if _, _, err := sqs.GetPriorNext(tctx, "Bob", req.EventUUID, 0); !errors.Is(err,
+		context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	sqs.Unlock()
+
+	if err := sqs.AddRecord(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := sqs.GetAllRows(ctx)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %d (%v)", len(rows), err)
+	}
+}
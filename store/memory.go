@@ -0,0 +1,594 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gdotgordon/ipverify/types"
+	"go.uber.org/zap"
+)
+
+// MemoryStore is an implementation of the Store interface that keeps
+// everything in memory, for tests, benchmarks and ephemeral deployments.
+// Each user's events are kept in a slice sorted by timestamp, so the prior
+// and next events are found with a binary search.  If a snapshot file is
+// given, the contents are written to it on Shutdown, and read back from
+// it by NewMemoryStore.
+type MemoryStore struct {
+	rwLock
+	users    map[string][]memEvent
+	uuids    map[string]string // event UUID to username
+	denylist map[string]types.DenylistEntry
+	audit    []types.AuditEntry
+	seq      int64 // insertion order, to break ties on the timestamp
+	snapshot string
+	log      *zap.SugaredLogger
+}
+
+type memEvent struct {
+	types.VerifyRequest
+	seq int64
+}
+
+// memSnapshot is the format of the snapshot file.  The events are in the
+// order they are to be added back, so ties on the timestamp keep their
+// order.
+type memSnapshot struct {
+	Events   []snapshotEvent       `json:"events"`
+	Denylist []types.DenylistEntry `json:"denylist"`
+	Audit    []types.AuditEntry    `json:"audit"`
+}
+
+// snapshotEvent holds the stored fields of an event, including the client,
+// location and verdict, which aren't part of the verify request's JSON.
+type snapshotEvent struct {
+	Username      string              `json:"username"`
+	UnixTimestamp int64               `json:"unixTimestamp"`
+	EventUUID     string              `json:"eventUuid"`
+	IPAddress     string              `json:"ipAddress"`
+	Client        string              `json:"client,omitempty"`
+	Geo           *types.EventGeo     `json:"geo,omitempty"`
+	Verdict       *types.EventVerdict `json:"verdict,omitempty"`
+}
+
+// NewMemoryStore creates a new, empty in-memory store, or, if the snapshot
+// file exists, one with the contents saved by a previous Shutdown.  An
+// empty snapshot path disables snapshots.
+func NewMemoryStore(snapshot string, log *zap.SugaredLogger) (*MemoryStore, error) {
+	ms := &MemoryStore{
+		users:    make(map[string][]memEvent),
+		uuids:    make(map[string]string),
+		denylist: make(map[string]types.DenylistEntry),
+		snapshot: snapshot,
+		log:      log,
+	}
+	if snapshot == "" {
+		return ms, nil
+	}
+	b, err := ioutil.ReadFile(snapshot)
+	if os.IsNotExist(err) {
+		return ms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap memSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %v", snapshot, err)
+	}
+	for _, e := range snap.Events {
+		if err := ms.add(types.VerifyRequest{Username: e.Username,
+			UnixTimestamp: e.UnixTimestamp, EventUUID: e.EventUUID, IPAddress: e.IPAddress,
+			Client: e.Client, Geo: e.Geo}); err != nil {
+			return nil, err
+		}
+		if e.Verdict != nil {
+			ms.setVerdict(e.EventUUID, *e.Verdict)
+		}
+	}
+	for _, e := range snap.Denylist {
+		ms.denylist[e.Entry] = e
+	}
+	ms.audit = snap.Audit
+	log.Infow("Loaded snapshot", "file", snapshot, "events", len(snap.Events))
+	return ms, nil
+}
+
+// lock acquires the write lock.  As nothing waits on I/O once the lock is
+// held, a done context is checked for up front, so it is never ignored.
+func (ms *MemoryStore) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.lockWrite(ctx)
+}
+
+// rlock acquires the read lock, checking the context like lock.
+func (ms *MemoryStore) rlock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.lockRead(ctx)
+}
+
+// AddRecord adds a single new request item to the store.  Adding an event
+// with a UUID that already exists fails.
+func (ms *MemoryStore) AddRecord(ctx context.Context, item types.VerifyRequest) error {
+	if err := ms.lock(ctx); err != nil {
+		return err
+	}
+	defer ms.Unlock()
+	defer observeQuery("add_record", time.Now())
+	return ms.add(item)
+}
+
+// add inserts the event into its user's timeline, after any events with
+// the same timestamp.  As with the other stores, only the event itself, the
+// client and the location are kept, not the request's options.
+func (ms *MemoryStore) add(req types.VerifyRequest) error {
+	if _, ok := ms.uuids[req.EventUUID]; ok {
+		return fmt.Errorf("event %s already exists", req.EventUUID)
+	}
+	item := types.VerifyRequest{Username: req.Username, UnixTimestamp: req.UnixTimestamp,
+		EventUUID: req.EventUUID, IPAddress: req.IPAddress, Client: req.Client}
+	if req.Geo != nil {
+		geo := *req.Geo
+		item.Geo = &geo
+	}
+	ms.seq++
+	events := ms.users[item.Username]
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].UnixTimestamp > item.UnixTimestamp
+	})
+	events = append(events, memEvent{})
+	copy(events[i+1:], events[i:])
+	events[i] = memEvent{VerifyRequest: item, seq: ms.seq}
+	ms.users[item.Username] = events
+	ms.uuids[item.EventUUID] = item.Username
+	return nil
+}
+
+// RecordVerdict records the verdict returned for an event.  An event that
+// has since been deleted is ignored.
+func (ms *MemoryStore) RecordVerdict(ctx context.Context, uuid string,
+	verdict types.EventVerdict) error {
+	if err := ms.lock(ctx); err != nil {
+		return err
+	}
+	defer ms.Unlock()
+	defer observeQuery("record_verdict", time.Now())
+	ms.setVerdict(uuid, verdict)
+	return nil
+}
+
+func (ms *MemoryStore) setVerdict(uuid string, verdict types.EventVerdict) {
+	events := ms.users[ms.uuids[uuid]]
+	for i := range events {
+		if events[i].EventUUID == uuid {
+			events[i].Verdict = &verdict
+			return
+		}
+	}
+}
+
+// RemoveRecord takes back an event that was just added, for a request that
+// failed.  Unlike the deletions, this is not audited.
+func (ms *MemoryStore) RemoveRecord(ctx context.Context, uuid string) error {
+	if err := ms.lock(ctx); err != nil {
+		return err
+	}
+	defer ms.Unlock()
+	defer observeQuery("remove_record", time.Now())
+
+	username, ok := ms.uuids[uuid]
+	if !ok {
+		return nil
+	}
+	for i, e := range ms.users[username] {
+		if e.EventUUID == uuid {
+			ms.removeEvents(username, i, i+1)
+			break
+		}
+	}
+	return nil
+}
+
+// GetAllRows gets all events in the store, oldest first.
+func (ms *MemoryStore) GetAllRows(ctx context.Context) ([]types.VerifyRequest, error) {
+	if err := ms.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer ms.RUnlock()
+	defer observeQuery("get_all_rows", time.Now())
+	return ms.allRows(), nil
+}
+
+func (ms *MemoryStore) allRows() []types.VerifyRequest {
+	all := make([]memEvent, 0, len(ms.uuids))
+	for _, events := range ms.users {
+		all = append(all, events...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].before(all[j]) })
+	var result []types.VerifyRequest
+	for _, e := range all {
+		result = append(result, e.VerifyRequest)
+	}
+	return result
+}
+
+// GetUserEvents gets a page of the events for a user, along with the total
+// number of events in the query's time range.
+func (ms *MemoryStore) GetUserEvents(ctx context.Context, username string,
+	query types.EventQuery) ([]types.VerifyRequest, int, error) {
+	if err := ms.rlock(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer ms.RUnlock()
+	defer observeQuery("get_user_events", time.Now())
+
+	events := ms.users[username]
+	lo, hi := 0, len(events)
+	if query.From != 0 {
+		lo = sort.Search(len(events), func(i int) bool {
+			return events[i].UnixTimestamp >= query.From
+		})
+	}
+	if query.To != 0 {
+		hi = sort.Search(len(events), func(i int) bool {
+			return events[i].UnixTimestamp > query.To
+		})
+	}
+	if hi < lo {
+		hi = lo
+	}
+	total := hi - lo
+	var result []types.VerifyRequest
+	for n := query.Offset; n < total && len(result) < query.Limit; n++ {
+		i := lo + n
+		if query.Order == types.Descending {
+			i = hi - 1 - n
+		}
+		result = append(result, events[i].VerifyRequest)
+	}
+	return result, total, nil
+}
+
+// GetPriorNext gets the events just before and just after the timestamp,
+// with the same semantics as for the SQLiteStore: an event at exactly the
+// same time is considered to be the prior event.
+func (ms *MemoryStore) GetPriorNext(ctx context.Context, username string, uuid string,
+	timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error) {
+	return ms.GetPriorNextMatching(ctx, username, uuid, timestamp, nil)
+}
+
+// GetPriorNextMatching is like GetPriorNext, but skips over any events for
+// which the match function returns false.  A nil match function matches
+// every event.
+func (ms *MemoryStore) GetPriorNextMatching(ctx context.Context, username string,
+	uuid string, timestamp int64, match func(types.VerifyRequest) bool) (*types.VerifyRequest,
+	*types.VerifyRequest, error) {
+	if err := ms.rlock(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer ms.RUnlock()
+	defer observeQuery("get_prior_next", time.Now())
+	var prev, next *types.VerifyRequest
+
+	// The first event after the timestamp splits the timeline; the prior
+	// event is found by searching back from there, and the next forward.
+	events := ms.users[username]
+	split := sort.Search(len(events), func(i int) bool {
+		return events[i].UnixTimestamp > timestamp
+	})
+	for i := split - 1; i >= 0; i-- {
+		if e := events[i].VerifyRequest; e.EventUUID != uuid && (match == nil || match(e)) {
+			prev = &e
+			break
+		}
+	}
+	for i := split; i < len(events); i++ {
+		if e := events[i].VerifyRequest; e.EventUUID != uuid && (match == nil || match(e)) {
+			next = &e
+			break
+		}
+	}
+	return prev, next, nil
+}
+
+// Clear deletes all the events, returning the number deleted.  The
+// deletion is recorded in the audit log.
+func (ms *MemoryStore) Clear(ctx context.Context) (int64, error) {
+	if err := ms.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer ms.Unlock()
+	defer observeQuery(string(types.AuditReset), time.Now())
+
+	n := int64(len(ms.uuids))
+	ms.users = make(map[string][]memEvent)
+	ms.uuids = make(map[string]string)
+	ms.addAudit(types.AuditReset, "", "", n)
+	return n, nil
+}
+
+// DeleteUser deletes all the events for a user, returning the number of
+// events deleted.  The deletion is recorded in the audit log.
+func (ms *MemoryStore) DeleteUser(ctx context.Context, username string) (int64, error) {
+	if err := ms.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer ms.Unlock()
+	defer observeQuery(string(types.AuditDeleteUser), time.Now())
+
+	events := ms.users[username]
+	for _, e := range events {
+		delete(ms.uuids, e.EventUUID)
+	}
+	delete(ms.users, username)
+	ms.addAudit(types.AuditDeleteUser, username, "", int64(len(events)))
+	return int64(len(events)), nil
+}
+
+// DeleteEvent deletes a single event for a user, returning the number of
+// events deleted, which is zero if the user has no such event.  The
+// deletion is recorded in the audit log.
+func (ms *MemoryStore) DeleteEvent(ctx context.Context, username string,
+	uuid string) (int64, error) {
+	if err := ms.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer ms.Unlock()
+	defer observeQuery(string(types.AuditDeleteEvent), time.Now())
+
+	var n int64
+	events := ms.users[username]
+	for i, e := range events {
+		if e.EventUUID == uuid {
+			ms.removeEvents(username, i, i+1)
+			n = 1
+			break
+		}
+	}
+	ms.addAudit(types.AuditDeleteEvent, username, uuid, n)
+	return n, nil
+}
+
+func (ms *MemoryStore) addAudit(action types.AuditAction, username string, uuid string,
+	n int64) {
+	ms.audit = append(ms.audit, types.AuditEntry{Action: action, Username: username,
+		EventUUID: uuid, Deleted: n, Created: time.Now().Unix()})
+	ms.log.Infow("deleted events", "action", action, "username", username,
+		"uuid", uuid, "count", n)
+}
+
+// removeEvents deletes the events from index i up to j of the user's
+// timeline.
+func (ms *MemoryStore) removeEvents(username string, i, j int) {
+	events := ms.users[username]
+	for _, e := range events[i:j] {
+		delete(ms.uuids, e.EventUUID)
+	}
+	events = append(events[:i], events[j:]...)
+	if len(events) == 0 {
+		delete(ms.users, username)
+		return
+	}
+	ms.users[username] = events
+}
+
+// PruneBefore deletes up to limit events older than the timestamp,
+// returning the number deleted.
+func (ms *MemoryStore) PruneBefore(ctx context.Context, timestamp int64,
+	limit int) (int64, error) {
+	return ms.prune(ctx, "prune_before", limit, func(events []memEvent) int {
+		return sort.Search(len(events), func(i int) bool {
+			return events[i].UnixTimestamp >= timestamp
+		})
+	})
+}
+
+// ExcessUsers gets the users with more than the maximum number of events,
+// in order of name.
+func (ms *MemoryStore) ExcessUsers(ctx context.Context, maxPerUser int) ([]string, error) {
+	if err := ms.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer ms.RUnlock()
+	defer observeQuery("excess_users", time.Now())
+
+	var result []string
+	for username, events := range ms.users {
+		if len(events) > maxPerUser {
+			result = append(result, username)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// PruneExcess deletes up to limit of the user's events beyond the maximum
+// number, oldest first, returning the number deleted.
+func (ms *MemoryStore) PruneExcess(ctx context.Context, username string, maxPerUser int,
+	limit int) (int64, error) {
+	if err := ms.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer ms.Unlock()
+	defer observeQuery("prune_excess", time.Now())
+
+	count := len(ms.users[username]) - maxPerUser
+	if count <= 0 {
+		return 0, nil
+	}
+	if count > limit {
+		count = limit
+	}
+	ms.removeEvents(username, 0, count)
+	return int64(count), nil
+}
+
+// prune deletes the oldest events of each user, as many as the excess
+// function returns, up to limit in all.
+func (ms *MemoryStore) prune(ctx context.Context, operation string, limit int,
+	excess func([]memEvent) int) (int64, error) {
+	if err := ms.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer ms.Unlock()
+	defer observeQuery(operation, time.Now())
+
+	var n int
+	for username, events := range ms.users {
+		if n == limit {
+			break
+		}
+		count := excess(events)
+		if count <= 0 {
+			continue
+		}
+		if count > limit-n {
+			count = limit - n
+		}
+		ms.removeEvents(username, 0, count)
+		n += count
+	}
+	return int64(n), nil
+}
+
+// GetAuditLog gets all the audit entries, oldest first.
+func (ms *MemoryStore) GetAuditLog(ctx context.Context) ([]types.AuditEntry, error) {
+	if err := ms.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer ms.RUnlock()
+	defer observeQuery("get_audit_log", time.Now())
+	return append([]types.AuditEntry(nil), ms.audit...), nil
+}
+
+// AddDenylistEntry adds a denylist entry.  Adding an entry that already
+// exists fails.
+func (ms *MemoryStore) AddDenylistEntry(ctx context.Context, entry types.DenylistEntry) error {
+	if err := ms.lock(ctx); err != nil {
+		return err
+	}
+	defer ms.Unlock()
+	defer observeQuery("add_denylist_entry", time.Now())
+
+	if _, ok := ms.denylist[entry.Entry]; ok {
+		return fmt.Errorf("denylist entry %s already exists", entry.Entry)
+	}
+	ms.denylist[entry.Entry] = entry
+	return nil
+}
+
+// RemoveDenylistEntry deletes a denylist entry, returning whether it existed.
+func (ms *MemoryStore) RemoveDenylistEntry(ctx context.Context, entry string) (bool, error) {
+	if err := ms.lock(ctx); err != nil {
+		return false, err
+	}
+	defer ms.Unlock()
+	defer observeQuery("remove_denylist_entry", time.Now())
+
+	_, ok := ms.denylist[entry]
+	delete(ms.denylist, entry)
+	return ok, nil
+}
+
+// GetDenylist gets all the denylist entries, in the order they were added.
+func (ms *MemoryStore) GetDenylist(ctx context.Context) ([]types.DenylistEntry, error) {
+	if err := ms.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer ms.RUnlock()
+	defer observeQuery("get_denylist", time.Now())
+	return ms.sortedDenylist(), nil
+}
+
+func (ms *MemoryStore) sortedDenylist() []types.DenylistEntry {
+	var result []types.DenylistEntry
+	for _, e := range ms.denylist {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Created != result[j].Created {
+			return result[i].Created < result[j].Created
+		}
+		return result[i].Entry < result[j].Entry
+	})
+	return result
+}
+
+// Ping always succeeds, as there is nothing to reach.
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Counts gets the number of events and denylist entries.
+func (ms *MemoryStore) Counts(ctx context.Context) (types.StoreCounts, error) {
+	var counts types.StoreCounts
+	if err := ms.rlock(ctx); err != nil {
+		return counts, err
+	}
+	defer ms.RUnlock()
+	counts.Events = int64(len(ms.uuids))
+	counts.Denylist = int64(len(ms.denylist))
+	return counts, nil
+}
+
+// Shutdown writes the snapshot, if there is one.  The file is replaced
+// atomically, so a failed write leaves the previous snapshot in place.
+func (ms *MemoryStore) Shutdown() {
+	if ms.snapshot == "" {
+		return
+	}
+	if err := ms.Lock(context.Background()); err != nil {
+		return
+	}
+	defer ms.Unlock()
+	if err := ms.writeSnapshot(); err != nil {
+		ms.log.Warnw("memory store snapshot error", "file", ms.snapshot, "error", err)
+		return
+	}
+	ms.log.Infow("Wrote snapshot", "file", ms.snapshot, "events", len(ms.uuids))
+}
+
+func (ms *MemoryStore) writeSnapshot() error {
+	snap := memSnapshot{Denylist: ms.sortedDenylist(), Audit: ms.audit}
+	for _, e := range ms.allRows() {
+		snap.Events = append(snap.Events, snapshotEvent{Username: e.Username,
+			UnixTimestamp: e.UnixTimestamp, EventUUID: e.EventUUID, IPAddress: e.IPAddress,
+			Client: e.Client, Geo: e.Geo, Verdict: e.Verdict})
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(ms.snapshot), filepath.Base(ms.snapshot))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), ms.snapshot)
+}
+
+// before orders events by timestamp, and then by the order they were added.
+func (e memEvent) before(other memEvent) bool {
+	if e.UnixTimestamp != other.UnixTimestamp {
+		return e.UnixTimestamp < other.UnixTimestamp
+	}
+	return e.seq < other.seq
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipverify",
+		Name:      "store_query_duration_seconds",
+		Help:      "Store query latency by operation, excluding the time waiting for the lock.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"operation"})
+
+	lockWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipverify",
+		Name:      "store_lock_wait_seconds",
+		Help:      "Time spent waiting for the store's read or write lock.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"lock"})
+)
+
+// lockWrite acquires the write lock, recording the time spent waiting,
+// unless the context is done first.
+func (l *rwLock) lockWrite(ctx context.Context) error {
+	start := time.Now()
+	err := l.Lock(ctx)
+	lockWait.WithLabelValues("write").Observe(time.Since(start).Seconds())
+	return err
+}
+
+// lockRead acquires the read lock, recording the time spent waiting,
+// unless the context is done first.
+func (l *rwLock) lockRead(ctx context.Context) error {
+	start := time.Now()
+	err := l.RLock(ctx)
+	lockWait.WithLabelValues("read").Observe(time.Since(start).Seconds())
+	return err
+}
+
+// observeQuery records the latency of an operation started at the given
+// time.  It is deferred once the lock is held, so it runs before the
+// deferred unlock.
+func observeQuery(operation string, start time.Time) {
+	queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
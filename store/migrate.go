@@ -0,0 +1,168 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Migration is a change to the SQLite schema.  Migrations are applied in
+// order of version, each in its own transaction along with its row in the
+// schema_version table, so a failed migration leaves no trace and is tried
+// again next time.
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Applied     int64  `json:"applied,omitempty"` // Unix time, 0 if pending
+	stmt        string
+}
+
+// migrations are the up migrations, in order.  The tables created by
+// NewSQLiteStore are the base schema, version 0.  Once released, a
+// migration must never be changed; make a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "add index on username and timestamp",
+		stmt:        `CREATE INDEX IF NOT EXISTS "userTimeIndex" ON items (Username, Unix)`,
+	},
+	{
+		Version:     2,
+		Description: "add location and verdict of each event",
+		stmt: `
+			ALTER TABLE items ADD COLUMN Lat REAL;
+			ALTER TABLE items ADD COLUMN Lon REAL;
+			ALTER TABLE items ADD COLUMN Radius INT;
+			ALTER TABLE items ADD COLUMN Country TEXT;
+			ALTER TABLE items ADD COLUMN Subdivision TEXT;
+			ALTER TABLE items ADD COLUMN City TEXT;
+			ALTER TABLE items ADD COLUMN TimeZone TEXT;
+			ALTER TABLE items ADD COLUMN ASN INT;
+			ALTER TABLE items ADD COLUMN ASOrg TEXT;
+			ALTER TABLE items ADD COLUMN GeoBuild INT;
+			ALTER TABLE items ADD COLUMN Verdict TEXT;`,
+	},
+	{
+		Version:     3,
+		Description: "add client of each event",
+		stmt:        `ALTER TABLE items ADD COLUMN Client TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+// SQLiteMigrations gets the migrations for the SQLite database at the
+// specified file location, with the time each was applied.  The database
+// is opened read-only, so it must already exist.
+func SQLiteMigrations(filepath string) ([]Migration, error) {
+	db, err := sql.Open("sqlite3", "file:"+filepath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrationStatus(db)
+}
+
+// MigrateSQLite creates the base schema of the SQLite database at the
+// specified file location if needed, and applies any pending migrations,
+// returning those applied.  NewSQLiteStore does the same, so this is only
+// needed to migrate a database without starting the service.
+func MigrateSQLite(filepath string, log *zap.SugaredLogger) ([]Migration, error) {
+	db, err := sql.Open("sqlite3", filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := createSchema(db, filepath, log); err != nil {
+		return nil, err
+	}
+	return migrate(db, log)
+}
+
+// migrationStatus gets all the migrations, with the time each was applied.
+// A database without a schema_version table has none applied.
+func migrationStatus(db *sql.DB) ([]Migration, error) {
+	result := append([]Migration(nil), migrations...)
+	var name string
+	err := db.QueryRow(`
+		SELECT name FROM sqlite_master WHERE type='table' AND name='schema_version'`).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT Version, Applied FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].Applied = applied[result[i].Version]
+	}
+	return result, nil
+}
+
+// migrate applies the pending migrations, returning those applied.
+func migrate(db *sql.DB, log *zap.SugaredLogger) ([]Migration, error) {
+	if _, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version(
+			Version INTEGER NOT NULL PRIMARY KEY,
+			Description TEXT NOT NULL,
+			Applied INT NOT NULL
+	);
+	`); err != nil {
+		log.Errorw("error creating table", "name", "schema_version", "error", err)
+		return nil, err
+	}
+	status, err := migrationStatus(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range status {
+		if m.Applied != 0 {
+			continue
+		}
+		m.Applied = time.Now().Unix()
+		if err := applyMigration(db, m); err != nil {
+			log.Errorw("migration failed", "version", m.Version, "error", err)
+			return applied, fmt.Errorf("migration %d (%s): %v", m.Version, m.Description, err)
+		}
+		log.Infow("Applied migration", "version", m.Version, "description", m.Description)
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(m.stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version(Version, Description, Applied) values(?, ?, ?)`,
+		m.Version, m.Description, m.Applied); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "requests.db")
+	log := zap.NewNop().Sugar()
+
+	// Inspecting a database that doesn't exist fails, rather than creating it.
+	if _, err := SQLiteMigrations(path); err == nil {
+		t.Error("expected error inspecting missing database")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no database file, got %v", err)
+	}
+
+	// A database from before migrations has the base schema but no
+	// schema_version table, so every migration is pending.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createSchema(db, path, log); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	status, err := SQLiteMigrations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("expected %d migrations, got %d", len(migrations), len(status))
+	}
+	for i, m := range status {
+		if m.Version != i+1 || m.Applied != 0 {
+			t.Errorf("expected migration %d pending, got %+v", i+1, m)
+		}
+	}
+
+	applied, err := MigrateSQLite(path, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(migrations), len(applied))
+	}
+	if applied, err := MigrateSQLite(path, log); err != nil || len(applied) != 0 {
+		t.Errorf("expected no migrations applied, got %d (%v)", len(applied), err)
+	}
+	status, err = SQLiteMigrations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if m.Applied == 0 {
+			t.Errorf("expected migration %d applied", m.Version)
+		}
+	}
+
+	// The neighbor queries use the index on the username and timestamp.
+	sqs, err := NewSQLiteStore(path, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqs.Shutdown()
+	rows, err := sqs.db.Query(`
+		EXPLAIN QUERY PLAN SELECT Uuid, Username, Ipaddr, Unix FROM items
+		WHERE Username = ? AND Uuid != ? AND Unix <= ?
+		ORDER BY Unix DESC, rowid DESC LIMIT 1`, "Bob", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if p := strings.Join(plan, "\n"); !strings.Contains(p, "userTimeIndex") ||
+		strings.Contains(p, "TEMP B-TREE") {
+		t.Errorf("expected query to use userTimeIndex for the order, got plan %q", plan)
+	}
+}
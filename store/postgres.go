@@ -0,0 +1,500 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gdotgordon/ipverify/types"
+
+	// Load postgres driver
+	_ "github.com/lib/pq"
+
+	"go.uber.org/zap"
+)
+
+// schemaLockID is the key of the advisory lock held while creating the
+// schema, so replicas starting at the same time don't race to create it.
+const schemaLockID = 0x69707665
+
+// PostgresStore is an implementation of the Store interface backed by
+// PostgreSQL.  Unlike the SQLiteStore, there is no lock in the process:
+// concurrent access is left to the database, so any number of replicas
+// of the service may share the store.  The Id column records the order
+// events were added, in place of SQLite's rowid.
+type PostgresStore struct {
+	db  *sql.DB
+	log *zap.SugaredLogger
+}
+
+// NewPostgresStore creates a new store for the PostgreSQL database with the
+// given connection string, either a URL or key=value pairs, creating the
+// tables and indexes if needed.
+func NewPostgresStore(dsn string, log *zap.SugaredLogger) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := createPostgresSchema(db, log); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: db, log: log}, nil
+}
+
+// AddRecord adds a single new request item to the database.
+func (ps *PostgresStore) AddRecord(ctx context.Context, item types.VerifyRequest) error {
+	defer observeQuery("add_record", time.Now())
+
+	ps.log.Debugw("adding db row", "item", item)
+	args := append([]interface{}{item.EventUUID, item.Username, item.IPAddress,
+		item.UnixTimestamp, item.Client}, geoArgs(item.Geo)...)
+	_, err := ps.db.ExecContext(ctx, `
+		INSERT INTO items(Uuid, Username, Ipaddr, Unix, Client, `+geoColumns+`)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`, args...)
+	if err != nil {
+		ps.log.Errorw("adding db row failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// RecordVerdict records the verdict returned for an event.  An event that
+// has since been deleted is ignored.
+func (ps *PostgresStore) RecordVerdict(ctx context.Context, uuid string,
+	verdict types.EventVerdict) error {
+	defer observeQuery("record_verdict", time.Now())
+	b, err := json.Marshal(verdict)
+	if err != nil {
+		return err
+	}
+	_, err = ps.db.ExecContext(ctx, `UPDATE items SET Verdict = $1 WHERE Uuid = $2`,
+		string(b), uuid)
+	return err
+}
+
+// RemoveRecord takes back an event that was just added, for a request that
+// failed.  Unlike the deletions, this is not audited.
+func (ps *PostgresStore) RemoveRecord(ctx context.Context, uuid string) error {
+	defer observeQuery("remove_record", time.Now())
+	_, err := ps.db.ExecContext(ctx, `DELETE FROM items WHERE Uuid = $1`, uuid)
+	return err
+}
+
+// GetAllRows gets all rows in the store.
+func (ps *PostgresStore) GetAllRows(ctx context.Context) ([]types.VerifyRequest, error) {
+	defer observeQuery("get_all_rows", time.Now())
+
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT `+eventColumns+` FROM items
+		ORDER BY Unix ASC, Id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	return ps.scanEvents(rows)
+}
+
+// GetUserEvents gets a page of the events for a user, along with the total
+// number of events in the query's time range.
+func (ps *PostgresStore) GetUserEvents(ctx context.Context, username string,
+	query types.EventQuery) ([]types.VerifyRequest, int, error) {
+	defer observeQuery("get_user_events", time.Now())
+
+	where := "WHERE Username = $1"
+	args := []interface{}{username}
+	if query.From != 0 {
+		args = append(args, query.From)
+		where += fmt.Sprintf(" AND Unix >= $%d", len(args))
+	}
+	if query.To != 0 {
+		args = append(args, query.To)
+		where += fmt.Sprintf(" AND Unix <= $%d", len(args))
+	}
+	order := "ASC"
+	if query.Order == types.Descending {
+		order = "DESC"
+	}
+
+	var total int
+	if err := ps.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM items "+where,
+		args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// Ties on the timestamp are broken by insertion order, so the pages
+	// are stable.
+	sqlEvents := fmt.Sprintf(`
+		SELECT %s FROM items %s
+		ORDER BY Unix %s, Id %s LIMIT $%d OFFSET $%d`, eventColumns, where, order, order,
+		len(args)+1, len(args)+2)
+	rows, err := ps.db.QueryContext(ctx, sqlEvents, append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	result, err := ps.scanEvents(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, total, nil
+}
+
+// GetPriorNext gets the events just before and just after the timestamp,
+// with the same semantics as for the SQLiteStore: an event at exactly the
+// same time is considered to be the prior event, and of several, the one
+// stored last.
+func (ps *PostgresStore) GetPriorNext(ctx context.Context, username string, uuid string,
+	timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error) {
+	return ps.GetPriorNextMatching(ctx, username, uuid, timestamp, nil)
+}
+
+// GetPriorNextMatching is like GetPriorNext, but skips over any events for
+// which the match function returns false.  A nil match function matches
+// every event.
+func (ps *PostgresStore) GetPriorNextMatching(ctx context.Context, username string,
+	uuid string, timestamp int64, match func(types.VerifyRequest) bool) (*types.VerifyRequest,
+	*types.VerifyRequest, error) {
+	defer observeQuery("get_prior_next", time.Now())
+	var prev, next *types.VerifyRequest
+
+	limit := ""
+	if match == nil {
+		limit = " LIMIT 1"
+	}
+	for _, v := range []string{`
+		SELECT ` + eventColumns + ` FROM items
+		WHERE Username = $1 AND Uuid != $2 AND Unix <= $3
+		ORDER BY Unix DESC, Id DESC` + limit,
+		`SELECT ` + eventColumns + ` FROM items
+		WHERE Username = $1 AND Uuid != $2 AND Unix > $3
+		ORDER BY Unix ASC, Id ASC` + limit,
+	} {
+		rows, err := ps.db.QueryContext(ctx, v, username, uuid, timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			item, err := scanEvent(rows)
+			if err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if match != nil && !match(item) {
+				continue
+			}
+			if item.UnixTimestamp <= timestamp {
+				prev = &item
+			} else {
+				next = &item
+			}
+			break
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			ps.log.Errorw("row iterator failed", "error", err)
+			return nil, nil, err
+		}
+	}
+	return prev, next, nil
+}
+
+// Clear deletes all the rows from the table, returning the number deleted.
+// The deletion is recorded in the audit table.
+func (ps *PostgresStore) Clear(ctx context.Context) (int64, error) {
+	return ps.deleteAudited(ctx, types.AuditReset, "", "", "DELETE FROM items")
+}
+
+// DeleteUser deletes all the events for a user, returning the number of
+// events deleted.  The deletion is recorded in the audit table.
+func (ps *PostgresStore) DeleteUser(ctx context.Context, username string) (int64, error) {
+	return ps.deleteAudited(ctx, types.AuditDeleteUser, username, "",
+		`DELETE FROM items WHERE Username = $1`, username)
+}
+
+// DeleteEvent deletes a single event for a user, returning the number of
+// events deleted, which is zero if the user has no such event.  The
+// deletion is recorded in the audit table.
+func (ps *PostgresStore) DeleteEvent(ctx context.Context, username string,
+	uuid string) (int64, error) {
+	return ps.deleteAudited(ctx, types.AuditDeleteEvent, username, uuid,
+		`DELETE FROM items WHERE Username = $1 AND Uuid = $2`, username, uuid)
+}
+
+// deleteAudited runs the delete statement and adds the audit entry in a
+// single transaction, so there is never a deletion without a record of it.
+func (ps *PostgresStore) deleteAudited(ctx context.Context, action types.AuditAction,
+	username string, uuid string, query string, args ...interface{}) (int64, error) {
+	defer observeQuery(string(action), time.Now())
+
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO audit(Action, Username, Uuid, Deleted, Created)
+		VALUES($1, $2, $3, $4, $5)`, action, username, uuid, n, time.Now().Unix()); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	ps.log.Infow("deleted db rows", "action", action, "username", username,
+		"uuid", uuid, "count", n)
+	return n, nil
+}
+
+// PruneBefore deletes up to limit events older than the timestamp,
+// returning the number deleted.
+func (ps *PostgresStore) PruneBefore(ctx context.Context, timestamp int64,
+	limit int) (int64, error) {
+	return ps.pruneRows(ctx, "prune_before", `
+		DELETE FROM items WHERE Id IN (
+			SELECT Id FROM items WHERE Unix < $1 LIMIT $2)`, timestamp, limit)
+}
+
+// ExcessUsers gets the users with more than the maximum number of events.
+func (ps *PostgresStore) ExcessUsers(ctx context.Context, maxPerUser int) ([]string, error) {
+	defer observeQuery("excess_users", time.Now())
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT Username FROM items GROUP BY Username HAVING COUNT(*) > $1`, maxPerUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		result = append(result, username)
+	}
+	return result, rows.Err()
+}
+
+// PruneExcess deletes up to limit of the user's events beyond the maximum
+// number, oldest first, returning the number deleted.
+func (ps *PostgresStore) PruneExcess(ctx context.Context, username string, maxPerUser int,
+	limit int) (int64, error) {
+	return ps.pruneRows(ctx, "prune_excess", `
+		DELETE FROM items WHERE Id IN (
+			SELECT Id FROM items WHERE Username = $1
+			ORDER BY Unix DESC, Id DESC LIMIT $2 OFFSET $3)`, username, limit, maxPerUser)
+}
+
+// pruneRows deletes the rows in a single statement, as there is no lock
+// to release in between finding and deleting them.
+func (ps *PostgresStore) pruneRows(ctx context.Context, operation string, query string,
+	args ...interface{}) (int64, error) {
+	defer observeQuery(operation, time.Now())
+	res, err := ps.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetAuditLog gets all the audit entries, oldest first.
+func (ps *PostgresStore) GetAuditLog(ctx context.Context) ([]types.AuditEntry, error) {
+	defer observeQuery("get_audit_log", time.Now())
+
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT Action, Username, Uuid, Deleted, Created FROM audit
+		ORDER BY Id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []types.AuditEntry
+	for rows.Next() {
+		item := types.AuditEntry{}
+		if err := rows.Scan(&item.Action, &item.Username, &item.EventUUID,
+			&item.Deleted, &item.Created); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		ps.log.Errorw("row iterator failed", "error", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// AddDenylistEntry persists a denylist entry.  Adding an entry that already
+// exists fails with a constraint violation.
+func (ps *PostgresStore) AddDenylistEntry(ctx context.Context, entry types.DenylistEntry) error {
+	defer observeQuery("add_denylist_entry", time.Now())
+
+	_, err := ps.db.ExecContext(ctx, `
+		INSERT INTO denylist(Entry, Comment, Created) VALUES($1, $2, $3)`,
+		entry.Entry, entry.Comment, entry.Created)
+	if err != nil {
+		ps.log.Errorw("adding denylist row failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// RemoveDenylistEntry deletes a denylist entry, returning whether it existed.
+func (ps *PostgresStore) RemoveDenylistEntry(ctx context.Context, entry string) (bool, error) {
+	defer observeQuery("remove_denylist_entry", time.Now())
+
+	res, err := ps.db.ExecContext(ctx, `DELETE FROM denylist WHERE Entry = $1`, entry)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetDenylist gets all the denylist entries, in the order they were added.
+func (ps *PostgresStore) GetDenylist(ctx context.Context) ([]types.DenylistEntry, error) {
+	defer observeQuery("get_denylist", time.Now())
+
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT Entry, Comment, Created FROM denylist
+		ORDER BY Created ASC, Entry ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []types.DenylistEntry
+	for rows.Next() {
+		item := types.DenylistEntry{}
+		if err := rows.Scan(&item.Entry, &item.Comment, &item.Created); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		ps.log.Errorw("row iterator failed", "error", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// Ping checks that the database can be reached, and that the events table
+// can be read, without scanning it.
+func (ps *PostgresStore) Ping(ctx context.Context) error {
+	defer observeQuery("ping", time.Now())
+
+	var one int
+	err := ps.db.QueryRowContext(ctx, "SELECT 1 FROM items LIMIT 1").Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return err
+}
+
+// Counts gets the number of rows in the events and denylist tables.
+func (ps *PostgresStore) Counts(ctx context.Context) (types.StoreCounts, error) {
+	defer observeQuery("counts", time.Now())
+
+	var counts types.StoreCounts
+	err := ps.db.QueryRowContext(ctx, `
+		SELECT (SELECT COUNT(*) FROM items), (SELECT COUNT(*) FROM denylist)`).Scan(
+		&counts.Events, &counts.Denylist)
+	return counts, err
+}
+
+// Shutdown does cleanup on termination
+func (ps *PostgresStore) Shutdown() {
+	if err := ps.db.Close(); err != nil {
+		ps.log.Warnw("postgres shutdown error", "error", err)
+	}
+}
+
+// scanEvents reads the events from the rows, closing them.
+func (ps *PostgresStore) scanEvents(rows *sql.Rows) ([]types.VerifyRequest, error) {
+	defer rows.Close()
+
+	var result []types.VerifyRequest
+	for rows.Next() {
+		item, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		ps.log.Errorw("row iterator failed", "error", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// createPostgresSchema creates the tables and indexes if needed, and adds
+// any columns added since to existing tables.  The index on the username
+// and timestamp serves the neighbor queries, which always look within a
+// single user's events.
+func createPostgresSchema(db *sql.DB, log *zap.SugaredLogger) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, schemaLockID); err != nil {
+		return err
+	}
+	for _, stmt := range []string{`
+		CREATE TABLE IF NOT EXISTS items(
+			Id BIGSERIAL UNIQUE,
+			Uuid TEXT NOT NULL PRIMARY KEY,
+			Username TEXT NOT NULL,
+			Ipaddr TEXT NOT NULL,
+			Unix BIGINT NOT NULL,
+			Client TEXT NOT NULL DEFAULT ''
+		)`,
+		`ALTER TABLE items
+			ADD COLUMN IF NOT EXISTS Lat DOUBLE PRECISION,
+			ADD COLUMN IF NOT EXISTS Lon DOUBLE PRECISION,
+			ADD COLUMN IF NOT EXISTS Radius INTEGER,
+			ADD COLUMN IF NOT EXISTS Country TEXT,
+			ADD COLUMN IF NOT EXISTS Subdivision TEXT,
+			ADD COLUMN IF NOT EXISTS City TEXT,
+			ADD COLUMN IF NOT EXISTS TimeZone TEXT,
+			ADD COLUMN IF NOT EXISTS ASN BIGINT,
+			ADD COLUMN IF NOT EXISTS ASOrg TEXT,
+			ADD COLUMN IF NOT EXISTS GeoBuild BIGINT,
+			ADD COLUMN IF NOT EXISTS Verdict TEXT`,
+		`CREATE INDEX IF NOT EXISTS items_user_time ON items (Username, Unix)`,
+		`CREATE INDEX IF NOT EXISTS items_time ON items (Unix)`,
+		`CREATE TABLE IF NOT EXISTS denylist(
+			Entry TEXT NOT NULL PRIMARY KEY,
+			Comment TEXT NOT NULL,
+			Created BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit(
+			Id BIGSERIAL PRIMARY KEY,
+			Action TEXT NOT NULL,
+			Username TEXT NOT NULL,
+			Uuid TEXT NOT NULL,
+			Deleted BIGINT NOT NULL,
+			Created BIGINT NOT NULL
+		)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			log.Errorw("error creating postgres schema", "error", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
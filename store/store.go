@@ -2,9 +2,13 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
-	"sync"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gdotgordon/ipverify/types"
 
@@ -19,25 +23,48 @@ const sqlAdditem = `
 		Uuid,
 		Username,
 		Ipaddr,
-        Unix
-    ) values(?, ?, ?, ?)`
+        Unix,
+        Client,
+        ` + geoColumns + `
+    ) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 // Store is the datastore abstraction for storing IP verify requests and retrieving
-// them for checks for suspicious activity.
+// them for checks for suspicious activity.  Each call gives up, returning the
+// context's error, once the context is done, whether it is waiting for
+// access to the store or in the middle of a query.
 type Store interface {
-	AddRecord(types.VerifyRequest) error
-	GetAllRows() ([]types.VerifyRequest, error)
-	GetPriorNext(username string, uuid string, timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error)
-	Clear() error
+	AddRecord(context.Context, types.VerifyRequest) error
+	RecordVerdict(ctx context.Context, uuid string, verdict types.EventVerdict) error
+	RemoveRecord(ctx context.Context, uuid string) error
+	GetAllRows(ctx context.Context) ([]types.VerifyRequest, error)
+	GetUserEvents(ctx context.Context, username string,
+		query types.EventQuery) ([]types.VerifyRequest, int, error)
+	GetPriorNext(ctx context.Context, username string, uuid string,
+		timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error)
+	GetPriorNextMatching(ctx context.Context, username string, uuid string, timestamp int64,
+		match func(types.VerifyRequest) bool) (*types.VerifyRequest, *types.VerifyRequest, error)
+	Clear(ctx context.Context) (int64, error)
+	DeleteUser(ctx context.Context, username string) (int64, error)
+	DeleteEvent(ctx context.Context, username string, uuid string) (int64, error)
+	PruneBefore(ctx context.Context, timestamp int64, limit int) (int64, error)
+	ExcessUsers(ctx context.Context, maxPerUser int) ([]string, error)
+	PruneExcess(ctx context.Context, username string, maxPerUser int, limit int) (int64, error)
+	AddDenylistEntry(context.Context, types.DenylistEntry) error
+	RemoveDenylistEntry(ctx context.Context, entry string) (bool, error)
+	GetDenylist(ctx context.Context) ([]types.DenylistEntry, error)
+	Ping(ctx context.Context) error
+	Counts(ctx context.Context) (types.StoreCounts, error)
 	Shutdown()
 }
 
 // SQLiteStore is an implementation of the Store interface that uses the
 // mattn/go-sqlite3 DB driver.  Note the documentation states that it the
 // driver is safe for concurrent reads, but there are issues with concurrent
-// writes, hence a mutex is required.
+// writes, hence a lock is required.  Waiting for the lock is abandoned when
+// the caller's context is done, so a slow writer can't hold up requests
+// beyond their deadlines.
 type SQLiteStore struct {
-	sync.RWMutex
+	rwLock
 	db      *sql.DB
 	addStmt *sql.Stmt
 	log     *zap.SugaredLogger
@@ -53,7 +80,10 @@ func NewSQLiteStore(filepath string, log *zap.SugaredLogger) (*SQLiteStore, erro
 		return nil, errors.New("unable to open database")
 	}
 
-	if err := createTable(db, filepath, log); err != nil {
+	if err := createSchema(db, filepath, log); err != nil {
+		return nil, err
+	}
+	if _, err := migrate(db, log); err != nil {
 		return nil, err
 	}
 	addStmt, err := db.Prepare(sqlAdditem)
@@ -64,12 +94,17 @@ func NewSQLiteStore(filepath string, log *zap.SugaredLogger) (*SQLiteStore, erro
 }
 
 // AddRecord adds a single new request item to the database.
-func (sqs *SQLiteStore) AddRecord(item types.VerifyRequest) error {
-	sqs.Lock()
+func (sqs *SQLiteStore) AddRecord(ctx context.Context, item types.VerifyRequest) error {
+	if err := sqs.lockWrite(ctx); err != nil {
+		return err
+	}
 	defer sqs.Unlock()
+	defer observeQuery("add_record", time.Now())
 
 	sqs.log.Debugw("adding db row", "item", item)
-	_, err := sqs.addStmt.Exec(item.EventUUID, item.Username, item.IPAddress, item.UnixTimestamp)
+	args := append([]interface{}{item.EventUUID, item.Username, item.IPAddress,
+		item.UnixTimestamp, item.Client}, geoArgs(item.Geo)...)
+	_, err := sqs.addStmt.ExecContext(ctx, args...)
 	if err != nil {
 		sqs.log.Errorw("adding db row failed", "error", err)
 		return err
@@ -77,16 +112,51 @@ func (sqs *SQLiteStore) AddRecord(item types.VerifyRequest) error {
 	return nil
 }
 
+// RecordVerdict records the verdict returned for an event.  An event that
+// has since been deleted is ignored.
+func (sqs *SQLiteStore) RecordVerdict(ctx context.Context, uuid string,
+	verdict types.EventVerdict) error {
+	b, err := json.Marshal(verdict)
+	if err != nil {
+		return err
+	}
+	if err := sqs.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer sqs.Unlock()
+	defer observeQuery("record_verdict", time.Now())
+
+	_, err = sqs.db.ExecContext(ctx, `UPDATE items SET Verdict = ? WHERE Uuid = ?`,
+		string(b), uuid)
+	return err
+}
+
+// RemoveRecord takes back an event that was just added, for a request that
+// failed.  Unlike the deletions, this is not audited.
+func (sqs *SQLiteStore) RemoveRecord(ctx context.Context, uuid string) error {
+	if err := sqs.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer sqs.Unlock()
+	defer observeQuery("remove_record", time.Now())
+
+	_, err := sqs.db.ExecContext(ctx, `DELETE FROM items WHERE Uuid = ?`, uuid)
+	return err
+}
+
 // GetAllRows gets all rows in the store.
-func (sqs *SQLiteStore) GetAllRows() ([]types.VerifyRequest, error) {
+func (sqs *SQLiteStore) GetAllRows(ctx context.Context) ([]types.VerifyRequest, error) {
 	sqlReadall := `
-		SELECT Uuid, Username, Ipaddr, Unix FROM items
-        ORDER BY Unix ASC
+		SELECT ` + eventColumns + ` FROM items
+        ORDER BY Unix ASC, rowid ASC
         `
-	sqs.RLock()
+	if err := sqs.lockRead(ctx); err != nil {
+		return nil, err
+	}
 	defer sqs.RUnlock()
+	defer observeQuery("get_all_rows", time.Now())
 
-	rows, err := sqs.db.Query(sqlReadall)
+	rows, err := sqs.db.QueryContext(ctx, sqlReadall)
 	if err != nil {
 		return nil, err
 	}
@@ -94,10 +164,10 @@ func (sqs *SQLiteStore) GetAllRows() ([]types.VerifyRequest, error) {
 
 	var result []types.VerifyRequest
 	for rows.Next() {
-		item := types.VerifyRequest{}
-		err2 := rows.Scan(&item.EventUUID, &item.Username, &item.IPAddress, &item.UnixTimestamp)
-		if err2 != nil {
-			panic(err2)
+		item, err := scanEvent(rows)
+		if err != nil {
+			sqs.log.Errorw("row scan failed", "error", err)
+			return nil, err
 		}
 		result = append(result, item)
 	}
@@ -109,46 +179,126 @@ func (sqs *SQLiteStore) GetAllRows() ([]types.VerifyRequest, error) {
 	return result, nil
 }
 
+// GetUserEvents gets a page of the events for a user, along with the total
+// number of events in the query's time range.
+func (sqs *SQLiteStore) GetUserEvents(ctx context.Context, username string,
+	query types.EventQuery) ([]types.VerifyRequest, int, error) {
+	where := "WHERE Username = ?"
+	args := []interface{}{username}
+	if query.From != 0 {
+		where += " AND Unix >= ?"
+		args = append(args, query.From)
+	}
+	if query.To != 0 {
+		where += " AND Unix <= ?"
+		args = append(args, query.To)
+	}
+	order := "ASC"
+	if query.Order == types.Descending {
+		order = "DESC"
+	}
+
+	if err := sqs.lockRead(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer sqs.RUnlock()
+	defer observeQuery("get_user_events", time.Now())
+
+	var total int
+	if err := sqs.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM items "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// Ties on the timestamp are broken by insertion order, so the pages
+	// are stable.
+	sqlEvents := fmt.Sprintf(`
+		SELECT %s FROM items %s
+		ORDER BY Unix %s, rowid %s LIMIT ? OFFSET ?`, eventColumns, where, order, order)
+	rows, err := sqs.db.QueryContext(ctx, sqlEvents, append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var result []types.VerifyRequest
+	for rows.Next() {
+		item, err := scanEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		sqs.log.Errorw("row iterator failed", "error", err)
+		return nil, 0, err
+	}
+	return result, total, nil
+}
+
 // GetPriorNext is the key method for the security check logic.  It queries
 // to get both the item just prior to the current event and the one just
 // subsequent to it.  As documented, we consider the presumably rare case
 // of two logins for the same user at exactly the same Unix time as a
-// suspicious login, and capture it along with the prior events.
-func (sqs *SQLiteStore) GetPriorNext(username string, uuid string,
+// suspicious login, and capture it along with the prior events.  Of several
+// such logins, the one stored last is the prior event.
+func (sqs *SQLiteStore) GetPriorNext(ctx context.Context, username string, uuid string,
 	timestamp int64) (*types.VerifyRequest, *types.VerifyRequest, error) {
+	return sqs.GetPriorNextMatching(ctx, username, uuid, timestamp, nil)
+}
+
+// GetPriorNextMatching is like GetPriorNext, but skips over any events for
+// which the match function returns false, such as events from trusted
+// networks.  A nil match function matches every event.
+func (sqs *SQLiteStore) GetPriorNextMatching(ctx context.Context, username string,
+	uuid string, timestamp int64, match func(types.VerifyRequest) bool) (*types.VerifyRequest,
+	*types.VerifyRequest, error) {
 	var prev, next *types.VerifyRequest
 
-	sqs.RLock()
+	// Without a match function, only the first row of each query is needed.
+	// Otherwise, we read rows until one matches, which stops the query early.
+	limit := ""
+	if match == nil {
+		limit = " LIMIT 1"
+	}
+
+	if err := sqs.lockRead(ctx); err != nil {
+		return nil, nil, err
+	}
 	defer sqs.RUnlock()
+	defer observeQuery("get_prior_next", time.Now())
 
 	// Use two queries, one for prior timestamps (but return only the latest
 	// of those) and one for subsequent logins, again, only capturing the
 	// earliest of those.
 	for _, v := range []string{`
-        SELECT Uuid, Username, Ipaddr, Unix FROM items
+        SELECT ` + eventColumns + ` FROM items
         WHERE Username = ? AND Uuid != ? AND Unix <= ?
-		ORDER BY Unix DESC LIMIT 1`,
-		`SELECT Uuid, Username, Ipaddr, Unix FROM items
+		ORDER BY Unix DESC, rowid DESC` + limit,
+		`SELECT ` + eventColumns + ` FROM items
         WHERE Username = ? AND Uuid != ? AND Unix > ?
-		ORDER BY Unix ASC LIMIT 1`,
+		ORDER BY Unix ASC, rowid ASC` + limit,
 	} {
-		rows, err := sqs.db.Query(v, username, uuid, timestamp)
+		rows, err := sqs.db.QueryContext(ctx, v, username, uuid, timestamp)
 		if err != nil {
 			return nil, nil, err
 		}
 
 		for rows.Next() {
-			item := types.VerifyRequest{}
-			err2 := rows.Scan(&item.EventUUID, &item.Username, &item.IPAddress, &item.UnixTimestamp)
-			if err2 != nil {
+			item, err := scanEvent(rows)
+			if err != nil {
+				sqs.log.Errorw("row scan failed", "error", err)
 				rows.Close()
-				panic(err2)
+				return nil, nil, err
+			}
+			if match != nil && !match(item) {
+				continue
 			}
 			if item.UnixTimestamp <= timestamp {
 				prev = &item
 			} else {
 				next = &item
 			}
+			break
 		}
 		if err := rows.Err(); err != nil {
 			sqs.log.Errorw("row iterator failed", "error", err)
@@ -160,12 +310,295 @@ func (sqs *SQLiteStore) GetPriorNext(username string, uuid string,
 	return prev, next, nil
 }
 
-// Clear deletes all the rows from the table - useful for testing.
-func (sqs *SQLiteStore) Clear() error {
-	_, err := sqs.db.Exec("DELETE FROM items;")
+// Clear deletes all the rows from the table, returning the number deleted.
+// The deletion is recorded in the audit table.
+func (sqs *SQLiteStore) Clear(ctx context.Context) (int64, error) {
+	return sqs.deleteAudited(ctx, types.AuditReset, "", "", "DELETE FROM items")
+}
+
+// DeleteUser deletes all the events for a user, returning the number of
+// events deleted.  The deletion is recorded in the audit table.
+func (sqs *SQLiteStore) DeleteUser(ctx context.Context, username string) (int64, error) {
+	return sqs.deleteAudited(ctx, types.AuditDeleteUser, username, "",
+		`DELETE FROM items WHERE Username = ?`, username)
+}
+
+// DeleteEvent deletes a single event for a user, returning the number of
+// events deleted, which is zero if the user has no such event.  The
+// deletion is recorded in the audit table.
+func (sqs *SQLiteStore) DeleteEvent(ctx context.Context, username string,
+	uuid string) (int64, error) {
+	return sqs.deleteAudited(ctx, types.AuditDeleteEvent, username, uuid,
+		`DELETE FROM items WHERE Username = ? AND Uuid = ?`, username, uuid)
+}
+
+// deleteAudited runs the delete statement and adds the audit entry in a
+// single transaction, so there is never a deletion without a record of it.
+func (sqs *SQLiteStore) deleteAudited(ctx context.Context, action types.AuditAction,
+	username string, uuid string, query string, args ...interface{}) (int64, error) {
+	if err := sqs.lockWrite(ctx); err != nil {
+		return 0, err
+	}
+	defer sqs.Unlock()
+	defer observeQuery(string(action), time.Now())
+
+	tx, err := sqs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	sqlAudit := `INSERT INTO audit(Action, Username, Uuid, Deleted, Created) values(?, ?, ?, ?, ?)`
+	if _, err := tx.ExecContext(ctx, sqlAudit, action, username, uuid, n, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	sqs.log.Infow("deleted db rows", "action", action, "username", username,
+		"uuid", uuid, "count", n)
+	return n, nil
+}
+
+// PruneBefore deletes up to limit events older than the timestamp,
+// returning the number deleted.
+func (sqs *SQLiteStore) PruneBefore(ctx context.Context, timestamp int64,
+	limit int) (int64, error) {
+	return sqs.pruneRows(ctx, "prune_before", `
+		SELECT rowid FROM items WHERE Unix < ? LIMIT ?`, timestamp, limit)
+}
+
+// ExcessUsers gets the users with more than the maximum number of events.
+// The index on the username and timestamp serves the count, so the events
+// themselves are not read.
+func (sqs *SQLiteStore) ExcessUsers(ctx context.Context, maxPerUser int) ([]string, error) {
+	if err := sqs.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer sqs.RUnlock()
+	defer observeQuery("excess_users", time.Now())
+
+	rows, err := sqs.db.QueryContext(ctx, `
+		SELECT Username FROM items GROUP BY Username HAVING COUNT(*) > ?`, maxPerUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		result = append(result, username)
+	}
+	return result, rows.Err()
+}
+
+// PruneExcess deletes up to limit of the user's events beyond the maximum
+// number, oldest first, returning the number deleted.
+func (sqs *SQLiteStore) PruneExcess(ctx context.Context, username string, maxPerUser int,
+	limit int) (int64, error) {
+	return sqs.pruneRows(ctx, "prune_excess", `
+		SELECT rowid FROM items WHERE Username = ?
+		ORDER BY Unix DESC, rowid DESC LIMIT ? OFFSET ?`, username, limit, maxPerUser)
+}
+
+// pruneRows finds the rows to prune holding only the read lock, and then
+// deletes them by rowid, so the write lock is only held for the deletion
+// itself.  A row deleted in between is simply skipped.
+func (sqs *SQLiteStore) pruneRows(ctx context.Context, operation string, query string,
+	args ...interface{}) (int64, error) {
+	if err := sqs.lockRead(ctx); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	rows, err := sqs.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		sqs.RUnlock()
+		return 0, err
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			sqs.RUnlock()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	observeQuery(operation, start)
+	sqs.RUnlock()
+	if err != nil {
+		sqs.log.Errorw("row iterator failed", "error", err)
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	sqlDelete := "DELETE FROM items WHERE rowid IN (?" +
+		strings.Repeat(", ?", len(ids)-1) + ")"
+	if err := sqs.lockWrite(ctx); err != nil {
+		return 0, err
+	}
+	defer sqs.Unlock()
+	defer observeQuery("prune_delete", time.Now())
+	res, err := sqs.db.ExecContext(ctx, sqlDelete, ids...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetAuditLog gets all the audit entries, oldest first.
+func (sqs *SQLiteStore) GetAuditLog(ctx context.Context) ([]types.AuditEntry, error) {
+	sqlReadall := `
+		SELECT Action, Username, Uuid, Deleted, Created FROM audit
+		ORDER BY Id ASC
+		`
+	if err := sqs.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer sqs.RUnlock()
+	defer observeQuery("get_audit_log", time.Now())
+
+	rows, err := sqs.db.QueryContext(ctx, sqlReadall)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []types.AuditEntry
+	for rows.Next() {
+		item := types.AuditEntry{}
+		if err := rows.Scan(&item.Action, &item.Username, &item.EventUUID,
+			&item.Deleted, &item.Created); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		sqs.log.Errorw("row iterator failed", "error", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// AddDenylistEntry persists a denylist entry.  Adding an entry that already
+// exists fails with a constraint violation.
+func (sqs *SQLiteStore) AddDenylistEntry(ctx context.Context, entry types.DenylistEntry) error {
+	sqlAddEntry := `INSERT INTO denylist(Entry, Comment, Created) values(?, ?, ?)`
+	if err := sqs.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer sqs.Unlock()
+	defer observeQuery("add_denylist_entry", time.Now())
+
+	_, err := sqs.db.ExecContext(ctx, sqlAddEntry, entry.Entry, entry.Comment, entry.Created)
+	if err != nil {
+		sqs.log.Errorw("adding denylist row failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// RemoveDenylistEntry deletes a denylist entry, returning whether it existed.
+func (sqs *SQLiteStore) RemoveDenylistEntry(ctx context.Context, entry string) (bool, error) {
+	if err := sqs.lockWrite(ctx); err != nil {
+		return false, err
+	}
+	defer sqs.Unlock()
+	defer observeQuery("remove_denylist_entry", time.Now())
+
+	res, err := sqs.db.ExecContext(ctx, `DELETE FROM denylist WHERE Entry = ?`, entry)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetDenylist gets all the denylist entries, in the order they were added.
+func (sqs *SQLiteStore) GetDenylist(ctx context.Context) ([]types.DenylistEntry, error) {
+	sqlReadall := `
+		SELECT Entry, Comment, Created FROM denylist
+		ORDER BY Created ASC, Entry ASC
+		`
+	if err := sqs.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer sqs.RUnlock()
+	defer observeQuery("get_denylist", time.Now())
+
+	rows, err := sqs.db.QueryContext(ctx, sqlReadall)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []types.DenylistEntry
+	for rows.Next() {
+		item := types.DenylistEntry{}
+		if err := rows.Scan(&item.Entry, &item.Comment, &item.Created); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		sqs.log.Errorw("row iterator failed", "error", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// Ping checks that the database can be reached, and that the events table
+// can be read, without scanning it.
+func (sqs *SQLiteStore) Ping(ctx context.Context) error {
+	if err := sqs.lockRead(ctx); err != nil {
+		return err
+	}
+	defer sqs.RUnlock()
+	defer observeQuery("ping", time.Now())
+
+	var one int
+	err := sqs.db.QueryRowContext(ctx, "SELECT 1 FROM items LIMIT 1").Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
 	return err
 }
 
+// Counts gets the number of rows in the events and denylist tables.
+func (sqs *SQLiteStore) Counts(ctx context.Context) (types.StoreCounts, error) {
+	var counts types.StoreCounts
+	if err := sqs.lockRead(ctx); err != nil {
+		return counts, err
+	}
+	defer sqs.RUnlock()
+	defer observeQuery("counts", time.Now())
+
+	err := sqs.db.QueryRowContext(ctx, `
+		SELECT (SELECT COUNT(*) FROM items), (SELECT COUNT(*) FROM denylist)`).Scan(
+		&counts.Events, &counts.Denylist)
+	return counts, err
+}
+
 // Shutdown does cleanup on termination
 func (sqs *SQLiteStore) Shutdown() {
 	if err := sqs.addStmt.Close(); err != nil {
@@ -176,6 +609,17 @@ func (sqs *SQLiteStore) Shutdown() {
 	}
 }
 
+// Create the base schema, before any migrations, if needed.
+func createSchema(db *sql.DB, filepath string, log *zap.SugaredLogger) error {
+	if err := createTable(db, filepath, log); err != nil {
+		return err
+	}
+	if err := createDenylistTable(db, log); err != nil {
+		return err
+	}
+	return createAuditTable(db, log)
+}
+
 // Create the table if needed.
 func createTable(db *sql.DB, filepath string, log *zap.SugaredLogger) error {
 
@@ -228,3 +672,38 @@ func createTable(db *sql.DB, filepath string, log *zap.SugaredLogger) error {
 
 	return nil
 }
+
+// Create the denylist table if needed.
+func createDenylistTable(db *sql.DB, log *zap.SugaredLogger) error {
+	sqlTable := `
+	CREATE TABLE IF NOT EXISTS denylist(
+			Entry TEXT NOT NULL PRIMARY KEY,
+			Comment TEXT NOT NULL,
+			Created INT NOT NULL
+	);
+	`
+	if _, err := db.Exec(sqlTable); err != nil {
+		log.Errorw("error creating table", "name", "denylist", "error", err)
+		return err
+	}
+	return nil
+}
+
+// Create the audit table if needed.
+func createAuditTable(db *sql.DB, log *zap.SugaredLogger) error {
+	sqlTable := `
+	CREATE TABLE IF NOT EXISTS audit(
+			Id INTEGER PRIMARY KEY AUTOINCREMENT,
+			Action TEXT NOT NULL,
+			Username TEXT NOT NULL,
+			Uuid TEXT NOT NULL,
+			Deleted INT NOT NULL,
+			Created INT NOT NULL
+	);
+	`
+	if _, err := db.Exec(sqlTable); err != nil {
+		log.Errorw("error creating table", "name", "audit", "error", err)
+		return err
+	}
+	return nil
+}
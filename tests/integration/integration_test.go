@@ -45,8 +45,15 @@ type coords struct {
 	lon float64
 }
 
+// adminToken must match the one the service was started with.  The
+// docker-compose.test.yml override sets it for testing.
+var adminToken = os.Getenv("IPVERIFY_ADMIN_TOKEN")
+
 func TestMain(m *testing.M) {
 	// call flag.Parse() here if TestMain uses flags
+	if adminToken == "" {
+		adminToken = "integration-test-token"
+	}
 	verifyAddr, _ = getAppAddr("8080", "ipverify_ipverify_1", "ipverify", "ipverify_ipverify")
 	verifyClient = http.DefaultClient
 	os.Exit(m.Run())
@@ -68,12 +75,12 @@ func TestStatus(t *testing.T) {
 	if err != nil {
 		t.Fatal("error reading response body", err)
 	}
-	var statResp map[string]string
+	var statResp types.StatusResponse
 	if err := json.Unmarshal(b, &statResp); err != nil {
 		t.Fatal("error deserializing JSON", err)
 	}
-	if statResp["status"] != "IP verify service is up and running" {
-		t.Fatal("unexpected status repsonse", statResp["status"])
+	if statResp.Status != "IP verify service is up and running" {
+		t.Fatal("unexpected status repsonse", statResp.Status)
 	}
 }
 
@@ -300,7 +307,7 @@ func TestVerify(t *testing.T) {
 		expResp.CurrentGeo = v.expCurr
 		expResp.PrecedingIPAccess = v.expPrev
 		expResp.SubsequentIPAccess = v.expSucc
-		if !(reflect.DeepEqual(*resp, expResp)) {
+		if !(reflect.DeepEqual(travelOnly(*resp), expResp)) {
 			t.Errorf("'%s': Expected response: %v, got: %v", v.description, expResp, resp)
 		}
 	}
@@ -406,6 +413,26 @@ func makeGeoEvent(ip string, speed int64, suspicious bool,
 	}
 }
 
+// travelOnly reduces a verify response to the locations, speeds and
+// verdicts that TestVerify checks, leaving out the fields that depend on
+// the build of the MaxMind DB, such as the place names, and those derived
+// from the others, such as the risk scores.
+func travelOnly(resp types.VerifyResponse) types.VerifyResponse {
+	event := func(ge *types.GeoEvent) *types.GeoEvent {
+		if ge == nil {
+			return nil
+		}
+		return makeGeoEvent(ge.IP, ge.Speed, ge.SuspiciousTravel,
+			coords{ge.Lat, ge.Lon}, ge.Radius, ge.Timestamp)
+	}
+	return types.VerifyResponse{
+		CurrentGeo: makeCurrGeo(coords{resp.CurrentGeo.Lat, resp.CurrentGeo.Lon},
+			resp.CurrentGeo.Radius),
+		PrecedingIPAccess:  event(resp.PrecedingIPAccess),
+		SubsequentIPAccess: event(resp.SubsequentIPAccess),
+	}
+}
+
 func ago(d time.Duration, now int64) int64 {
 	return time.Unix(now, 0).Add(-1 * d).Unix()
 }
@@ -447,10 +474,12 @@ func invokeVerify(request types.VerifyRequest) (*types.VerifyResponse, int, erro
 }
 
 func invokeReset(t *testing.T) error {
-	req, err := http.NewRequest(http.MethodGet, "http://"+verifyAddr+"/v1/reset", nil)
+	req, err := http.NewRequest(http.MethodPost,
+		"http://"+verifyAddr+"/v1/admin/reset?confirm=delete-all-events", nil)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
 
 	resp, err := verifyClient.Do(req)
 	if err != nil {
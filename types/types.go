@@ -5,57 +5,397 @@ package types
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 )
 
 const (
-	// MaxSpeed is the limit such that any speed greater than this will
-	// trigger a suspicious alert.
+	// MaxSpeed is the default limit such that any speed greater than this
+	// will trigger a suspicious alert.  It is expressed in DefaultSpeedUnit.
 	MaxSpeed = 500
+
+	// DefaultSpeedUnit is the unit MaxSpeed is expressed in.
+	DefaultSpeedUnit = MilesPerHour
+)
+
+// SpeedUnit is the unit a speed threshold is expressed in.
+type SpeedUnit string
+
+// The supported speed units.  Note calculated speeds are always reported
+// in miles per hour, the units only affect how a threshold is interpreted.
+const (
+	MilesPerHour      SpeedUnit = "mph"
+	KilometersPerHour SpeedUnit = "kph"
+)
+
+// ParseSpeedUnit converts a string to a SpeedUnit, returning an error if
+// the unit is not supported.
+func ParseSpeedUnit(s string) (SpeedUnit, error) {
+	switch u := SpeedUnit(strings.ToLower(s)); u {
+	case MilesPerHour, KilometersPerHour:
+		return u, nil
+	default:
+		return "", fmt.Errorf("invalid speed unit: %s", s)
+	}
+}
+
+// SpeedThreshold is the limit used to decide whether travel between two
+// logins is suspicious.  It is echoed back in the verify response so the
+// caller knows what rule produced the verdict.
+type SpeedThreshold struct {
+	Speed float64   `json:"speed"`
+	Unit  SpeedUnit `json:"unit"`
+	Group string    `json:"group,omitempty"`
+}
+
+// InMilesPerHour returns the threshold converted to miles per hour.
+func (st SpeedThreshold) InMilesPerHour() float64 {
+	if st.Unit == KilometersPerHour {
+		return st.Speed * kmToMiles
+	}
+	return st.Speed
+}
+
+const kmToMiles = float64(0.621371192)
+
+// RiskLevel is a coarse grading of a risk score.
+type RiskLevel string
+
+// The risk levels, with scores in the ranges [0, RiskMedium),
+// [RiskMedium, RiskHigh) and [RiskHigh, 100] respectively.
+const (
+	LowRisk    RiskLevel = "low"
+	MediumRisk RiskLevel = "medium"
+	HighRisk   RiskLevel = "high"
+
+	RiskMedium = 40
+	RiskHigh   = 70
 )
 
+// RiskLevelFor converts a risk score in the range 0-100 to a RiskLevel.
+func RiskLevelFor(score int) RiskLevel {
+	switch {
+	case score >= RiskHigh:
+		return HighRisk
+	case score >= RiskMedium:
+		return MediumRisk
+	default:
+		return LowRisk
+	}
+}
+
+// ReasonCode identifies a rule that contributed to a verdict, other than
+// the travel speed.
+type ReasonCode string
+
+// The supported reason codes.
+const (
+	ReasonAnonymousProxy ReasonCode = "anonymous_proxy"
+	ReasonHosting        ReasonCode = "hosting_provider"
+	ReasonTorExit        ReasonCode = "tor_exit_node"
+	ReasonTrustedNetwork ReasonCode = "trusted_network"
+	ReasonDenylisted     ReasonCode = "denylisted"
+)
+
+// Reason is a rule that applied to a verify request, along with detail
+// such as the list entry or database that matched.
+type Reason struct {
+	Code   ReasonCode `json:"code"`
+	Detail string     `json:"detail,omitempty"`
+}
+
+// DenylistEntry is a single IP address or CIDR block on the denylist.
+// Entries loaded from the denylist file have the source "file", and
+// those added through the API have the source "api".
+type DenylistEntry struct {
+	Entry   string `json:"entry"`
+	Comment string `json:"comment,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Created int64  `json:"created,omitempty"`
+}
+
+// Denylist sources.
+const (
+	DenylistFile = "file"
+	DenylistAPI  = "api"
+)
+
+// DenylistResponse is the JSON returned when listing the denylist.
+type DenylistResponse struct {
+	Entries []DenylistEntry `json:"entries"`
+}
+
 // StatusResponse is the JSON returned for a liveness check as well as
-// for other status notifications such as a successful delete.
+// for other status notifications such as a successful delete, in which
+// case it includes the number of events deleted.
 type StatusResponse struct {
-	Status string `json:"status"`
+	Status  string      `json:"status"`
+	Deleted int64       `json:"deleted,omitempty"`
+	GeoDB   *GeoDBInfo  `json:"geoDb,omitempty"`
+	Pruning *PruneStats `json:"pruning,omitempty"`
+}
+
+// PruneStats counts the events deleted by the data retention policy, in
+// total and by the last run.
+type PruneStats struct {
+	Runs        int64 `json:"runs"`
+	Deleted     int64 `json:"deleted"`
+	LastRun     int64 `json:"lastRun"`
+	LastDeleted int64 `json:"lastDeleted"`
+}
+
+// The readiness of the service as a whole and of each of its dependencies.
+const (
+	Ready    = "ready"
+	Degraded = "degraded"
+)
+
+// ReadyResponse is the JSON returned for a readiness check.  The service
+// is only ready if all of its dependencies are.
+type ReadyResponse struct {
+	Status string         `json:"status"`
+	Store  StoreReadiness `json:"store"`
+	GeoDB  GeoDBReadiness `json:"geoDb"`
 }
 
-//VerifyRequest is the struct corresponding to the JSON sent
+// StoreReadiness reports whether the store could be reached and queried,
+// along with the number of rows it held when they were last counted.
+type StoreReadiness struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	CountedAt string `json:"countedAt,omitempty"`
+	StoreCounts
+}
+
+// StoreCounts is the number of rows in each table of the store.
+type StoreCounts struct {
+	Events   int64 `json:"events"`
+	Denylist int64 `json:"denylistEntries"`
+}
+
+// GeoDBReadiness reports whether the canary address could be geolocated,
+// along with the database in use and its build date.
+type GeoDBReadiness struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	CanaryIP  string `json:"canaryIp"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GeoDBInfo
+}
+
+// AuditAction identifies an operation recorded in the audit log.
+type AuditAction string
+
+// The audited actions.
+const (
+	AuditDeleteUser  AuditAction = "delete_user"
+	AuditDeleteEvent AuditAction = "delete_event"
+	AuditReset       AuditAction = "reset"
+)
+
+// AuditEntry records a deletion of user data, such as for an erasure
+// request or a reset of the whole database.  The username is not set for
+// a reset, and the event UUID is only set for the deletion of a single
+// event.
+type AuditEntry struct {
+	Action    AuditAction `json:"action"`
+	Username  string      `json:"username,omitempty"`
+	EventUUID string      `json:"eventUuid,omitempty"`
+	Deleted   int64       `json:"deleted"`
+	Created   int64       `json:"created"`
+}
+
+// GeoDBInfo describes the geolocation database currently in use.
+type GeoDBInfo struct {
+	Type          string `json:"type"`
+	BuildEpoch    uint   `json:"buildEpoch"`
+	ASNType       string `json:"asnType,omitempty"`
+	ASNBuildEpoch uint   `json:"asnBuildEpoch,omitempty"`
+}
+
+// VerifyRequest is the struct corresponding to the JSON sent
 // by the user to record a login and check suspicion.
 type VerifyRequest struct {
 	Username      string `json:"username"`
 	UnixTimestamp int64  `json:"unix_timestamp"`
 	EventUUID     string `json:"event_uuid"`
 	IPAddress     string `json:"ip_address"`
+
+	// Optional overrides of the configured suspicious-speed threshold.
+	// An explicit MaxSpeed takes precedence over a user group's threshold.
+	UserGroup string    `json:"user_group,omitempty"`
+	MaxSpeed  float64   `json:"max_speed,omitempty"`
+	SpeedUnit SpeedUnit `json:"speed_unit,omitempty"`
+
+	// DryRun evaluates the login against the stored events without
+	// recording it.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Client is the name of the authenticated API client that sent the
+	// request, which is recorded with the event.
+	Client string `json:"-"`
+
+	// Geo is the location looked up for the event, and Verdict the verdict
+	// returned for it, as recorded in the store.  Events recorded before
+	// these were kept have neither, and denylisted events have no location.
+	Geo     *EventGeo     `json:"-"`
+	Verdict *EventVerdict `json:"-"`
+}
+
+// EventGeo is the location of a stored event, along with the build of the
+// geolocation database it was looked up in.
+type EventGeo struct {
+	CurrentGeoStat
+	BuildEpoch uint `json:"buildEpoch,omitempty"`
+}
+
+// EventVerdict is the verdict returned when an event was verified, as
+// recorded with the event.  The travel is to and from the neighboring
+// events at the time, which later events may have since replaced.
+type EventVerdict struct {
+	Blocked    bool           `json:"blocked,omitempty"`
+	RiskScore  int            `json:"riskScore"`
+	RiskLevel  RiskLevel      `json:"riskLevel"`
+	Threshold  SpeedThreshold `json:"threshold"`
+	Preceding  *TravelVerdict `json:"preceding,omitempty"`
+	Subsequent *TravelVerdict `json:"subsequent,omitempty"`
+	Reasons    []Reason       `json:"reasons,omitempty"`
+}
+
+// TravelVerdict is the travel between a verified event and one of its
+// neighbors, as recorded in an EventVerdict.
+type TravelVerdict struct {
+	IP               string `json:"ip"`
+	Timestamp        int64  `json:"timestamp"`
+	Speed            int64  `json:"speed"`
+	AdjustedSpeed    int64  `json:"adjustedSpeed"`
+	SuspiciousTravel bool   `json:"suspiciousTravel"`
+	RiskScore        int    `json:"riskScore"`
 }
 
 // CurrentGeoStat is a member of the response object that contains
 // information about the corresponding incoming request.
 type CurrentGeoStat struct {
-	Lat    float64 `json:"lat"`
-	Lon    float64 `json:"lon"`
-	Radius uint16  `json:"radius"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Radius      uint16  `json:"radius"`
+	Country     string  `json:"country,omitempty"`
+	Subdivision string  `json:"subdivision,omitempty"`
+	City        string  `json:"city,omitempty"`
+	TimeZone    string  `json:"timeZone,omitempty"`
+	ASN         uint    `json:"asn,omitempty"`
+	ASOrg       string  `json:"asOrg,omitempty"`
 }
 
 // GeoEvent is used in the Verify response, as either the preceding
 // or subsequent location.  It also indicates the "speed", and whether
-// it is considered suspicious
+// it is considered suspicious.  The adjusted speed is the minimum
+// plausible speed once both accuracy radii are taken into account, and
+// is what the suspicious travel verdict is based on.  SameASN indicates
+// both logins came from the same autonomous system, and Trusted that one
+// of them came from a trusted network, so the travel was not flagged.
 type GeoEvent struct {
-	IP               string  `json:"ip"`
-	Speed            int64   `json:"speed"`
-	SuspiciousTravel bool    `json:"suspiciousTravel"`
-	Lat              float64 `json:"lat"`
-	Lon              float64 `json:"lon"`
-	Radius           uint16  `json:"radius"`
-	Timestamp        int64   `json:"timestamp"`
+	IP               string    `json:"ip"`
+	Speed            int64     `json:"speed"`
+	AdjustedSpeed    int64     `json:"adjustedSpeed"`
+	SuspiciousTravel bool      `json:"suspiciousTravel"`
+	RiskScore        int       `json:"riskScore"`
+	RiskLevel        RiskLevel `json:"riskLevel"`
+	Lat              float64   `json:"lat"`
+	Lon              float64   `json:"lon"`
+	Radius           uint16    `json:"radius"`
+	Country          string    `json:"country,omitempty"`
+	Subdivision      string    `json:"subdivision,omitempty"`
+	City             string    `json:"city,omitempty"`
+	TimeZone         string    `json:"timeZone,omitempty"`
+	ASN              uint      `json:"asn,omitempty"`
+	ASOrg            string    `json:"asOrg,omitempty"`
+	SameASN          bool      `json:"sameAsn,omitempty"`
+	Trusted          bool      `json:"trusted,omitempty"`
+	Timestamp        int64     `json:"timestamp"`
 }
 
 // VerifyResponse corresponds to the serialized JSON response.  Note both
 // the preceding and subsequent access items are pointers, so they may be
-// the JSON if not present.
+// the JSON if not present.  The overall risk score is the higher of the
+// preceding and subsequent access scores.  The anonymizer flags are set
+// independently of the travel speed, and are explained by the reasons.
+// A blocked response is for a denylisted address.  It has the maximum
+// risk score and the matching entry in the reasons, but no geo data.
+// DryRun indicates the login was evaluated but not recorded.
 type VerifyResponse struct {
+	DryRun             bool           `json:"dryRun,omitempty"`
+	Blocked            bool           `json:"blocked,omitempty"`
 	CurrentGeo         CurrentGeoStat `json:"currentGeo"`
 	PrecedingIPAccess  *GeoEvent      `json:"precedingIpAccess,omitempty"`
 	SubsequentIPAccess *GeoEvent      `json:"subsequentIpAccess,omitempty"`
+	Threshold          SpeedThreshold `json:"threshold"`
+	RiskScore          int            `json:"riskScore"`
+	RiskLevel          RiskLevel      `json:"riskLevel"`
+	AnonymousProxy     bool           `json:"anonymousProxy,omitempty"`
+	Hosting            bool           `json:"hosting,omitempty"`
+	TorExit            bool           `json:"torExit,omitempty"`
+	Reasons            []Reason       `json:"reasons,omitempty"`
+}
+
+// BatchVerifyResult is the result for one request of a batch verify.  The
+// index is the position of the request in the batch, and the status is the
+// HTTP status code the request would have had on its own.  Either the
+// result or the error is present, depending on the status.
+type BatchVerifyResult struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Result *VerifyResponse `json:"result,omitempty"`
+}
+
+// BatchVerifyResponse is the JSON returned for a batch verify, with the
+// results in the same order as the requests.
+type BatchVerifyResponse struct {
+	Results []BatchVerifyResult `json:"results"`
+}
+
+// SortOrder is the order events are listed in, by timestamp.
+type SortOrder string
+
+// The supported sort orders.
+const (
+	Ascending  SortOrder = "asc"
+	Descending SortOrder = "desc"
+)
+
+// EventQuery selects a page of a user's events.  The time range is
+// inclusive, and a zero From or To leaves that end of the range open.
+type EventQuery struct {
+	From   int64
+	To     int64
+	Limit  int
+	Offset int
+	Order  SortOrder
+}
+
+// UserEvent is a stored login, along with its location, and the travel
+// from the user's preceding login (if any).  The verdict is the one
+// returned when the login was verified, if it was recorded.
+type UserEvent struct {
+	EventUUID    string         `json:"eventUuid"`
+	IP           string         `json:"ip"`
+	Timestamp    int64          `json:"timestamp"`
+	Client       string         `json:"client,omitempty"`
+	Geo          CurrentGeoStat `json:"geo"`
+	GeoBuild     uint           `json:"geoBuildEpoch,omitempty"`
+	FromPrevious *GeoEvent      `json:"fromPrevious,omitempty"`
+	Verdict      *EventVerdict  `json:"verdict,omitempty"`
+}
+
+// UserEventsResponse is the JSON returned when listing a user's events.
+// Total is the number of events in the time range, across all pages.
+type UserEventsResponse struct {
+	Username string      `json:"username"`
+	Total    int         `json:"total"`
+	Limit    int         `json:"limit"`
+	Offset   int         `json:"offset"`
+	Events   []UserEvent `json:"events"`
 }
 
 func (v VerifyResponse) String() string {